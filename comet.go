@@ -1,7 +1,13 @@
 package comet
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type handleMessageFunc func(*Session, []byte)
@@ -10,11 +16,25 @@ type handleCloseFunc func(*Session, int, string) error
 type handleSessionFunc func(*Session)
 type filterFunc func(*Session) bool
 
+// Middleware wraps the handler of incoming messages, e.g. for logging, auth
+// checks, panic recovery or metrics. It returns the handler that runs instead
+// of next and decides whether and how next is called.
+type Middleware func(next func(*Session, []byte)) func(*Session, []byte)
+type authenticateFunc func(*http.Request) (map[string]interface{}, error)
+
+var (
+	// ErrUnauthorized rejects a request with 401 Unauthorized when returned by the authenticator.
+	ErrUnauthorized = errors.New("comet: unauthorized")
+
+	// ErrForbidden rejects a request with 403 Forbidden when returned by the authenticator.
+	ErrForbidden = errors.New("comet: forbidden")
+)
+
 // Comet implements a websocket manager.
 type (
 	Comet struct {
 		Config                   *Conf
-		messageHandler           handleMessageFunc
+		messageHandler           handleMessageFunc // nil until HandleMessage, unknown events then fail with ErrUnknownEvent
 		messageHandlerBinary     handleMessageFunc
 		messageSentHandler       handleMessageFunc
 		messageSentHandlerBinary handleMessageFunc
@@ -23,6 +43,18 @@ type (
 		connectHandler           handleSessionFunc
 		disconnectHandler        handleSessionFunc
 		pongHandler              handleSessionFunc
+		authenticateHandler      authenticateFunc
+		middlewares              []Middleware
+		textHandler              handleMessageFunc // dispatch wrapped in the middlewares
+		binaryHandler            handleMessageFunc // messageHandlerBinary wrapped in the middlewares
+		connectHooks             []handleSessionFunc
+		disconnectHooks          []handleSessionFunc
+		errorHooks               []handleErrorFunc
+		eventErrorHandler        func(*Session, string, error)
+		events                   map[string]*eventHandler
+		calls                    map[string]*Method
+		sessions                 *registry
+		handler                  HandlerFunc // serves ServeHTTP
 	}
 
 	Option func(*Conf)
@@ -35,9 +67,9 @@ func New(options ...Option) *Comet {
 		option(cfg)
 	}
 
-	return &Comet{
+	m := &Comet{
 		Config:                   cfg,
-		messageHandler:           func(*Session, []byte) {},
+		messageHandler:           nil,
 		messageHandlerBinary:     func(*Session, []byte) {},
 		messageSentHandler:       func(*Session, []byte) {},
 		messageSentHandlerBinary: func(*Session, []byte) {},
@@ -46,6 +78,83 @@ func New(options ...Option) *Comet {
 		connectHandler:           func(*Session) {},
 		disconnectHandler:        func(*Session) {},
 		pongHandler:              func(*Session) {},
+		eventErrorHandler:        emitError,
+		sessions:                 newRegistry(),
+	}
+	m.handler = HandleGws(m)
+	m.Use()
+	return m
+}
+
+// Use appends middlewares wrapping the text and binary message handlers, event
+// and call routing included. The first middleware is the outermost one.
+func (m *Comet) Use(middlewares ...Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+	m.textHandler = m.chain(m.dispatch)
+	m.binaryHandler = m.chain(func(s *Session, msg []byte) {
+		m.messageHandlerBinary(s, msg)
+	})
+}
+
+func (m *Comet) chain(handler handleMessageFunc) handleMessageFunc {
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		handler = m.middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recover returns a middleware recovering from panics of the message handlers,
+// the panic is passed to the error handler and the session stays open.
+func Recover() Middleware {
+	return func(next func(*Session, []byte)) func(*Session, []byte) {
+		return func(s *Session, msg []byte) {
+			defer func() {
+				if r := recover(); r != nil {
+					s.comet.handleError(s, fmt.Errorf("comet: message handler panic: %v", r))
+				}
+			}()
+			next(s, msg)
+		}
+	}
+}
+
+// HookConnect adds fn to the functions fired when a session connects, before the
+// HandleConnect handler. Unlike HandleConnect, hooks do not replace each other, so
+// libraries can attach to a comet instance without clobbering application handlers.
+func (m *Comet) HookConnect(fn func(*Session)) {
+	m.connectHooks = append(m.connectHooks, fn)
+}
+
+// HookDisconnect adds fn to the functions fired when a session disconnects, after
+// the HandleDisconnect handler.
+func (m *Comet) HookDisconnect(fn func(*Session)) {
+	m.disconnectHooks = append(m.disconnectHooks, fn)
+}
+
+// HookError adds fn to the functions fired when a session has an error, after the
+// HandleError handler.
+func (m *Comet) HookError(fn func(*Session, error)) {
+	m.errorHooks = append(m.errorHooks, fn)
+}
+
+func (m *Comet) handleConnect(s *Session) {
+	for _, hook := range m.connectHooks {
+		hook(s)
+	}
+	m.connectHandler(s)
+}
+
+func (m *Comet) handleDisconnect(s *Session) {
+	m.disconnectHandler(s)
+	for _, hook := range m.disconnectHooks {
+		hook(s)
+	}
+}
+
+func (m *Comet) handleError(s *Session, err error) {
+	m.errorHandler(s, err)
+	for _, hook := range m.errorHooks {
+		hook(s, err)
 	}
 }
 
@@ -89,6 +198,88 @@ func (m *Comet) HandleError(fn func(*Session, error)) {
 	m.errorHandler = fn
 }
 
+// HandleAuthenticate sets fn to authenticate requests before they become sessions.
+// The keys returned by fn seed the session keys. A request is rejected with
+// 403 Forbidden if fn returns an error wrapping ErrForbidden, any other error
+// rejects it with 401 Unauthorized. Websocket requests are authenticated before
+// the upgrade, tcp connections authenticate with their handshake frame.
+func (m *Comet) HandleAuthenticate(fn func(*http.Request) (map[string]interface{}, error)) {
+	m.authenticateHandler = fn
+}
+
+// authenticate runs the authenticator on r, it returns the session keys or
+// the http status and error the request is rejected with.
+func (m *Comet) authenticate(r *http.Request) (map[string]interface{}, int, error) {
+	keys := map[string]interface{}{}
+	if m.authenticateHandler == nil {
+		return keys, http.StatusOK, nil
+	}
+
+	authenticated, err := m.authenticateHandler(r)
+	if err != nil {
+		if errors.Is(err, ErrForbidden) {
+			return nil, http.StatusForbidden, err
+		}
+		return nil, http.StatusUnauthorized, err
+	}
+
+	for k, v := range authenticated {
+		keys[k] = v
+	}
+	return keys, http.StatusOK, nil
+}
+
+type requestKeysKey struct{}
+
+// WithRequestKeys returns a shallow copy of r carrying keys, the sessions the
+// request establishes start with them. Framework adapters use it to pass route
+// params to the session.
+func WithRequestKeys(r *http.Request, keys map[string]interface{}) *http.Request {
+	merged := map[string]interface{}{}
+	if previous, ok := r.Context().Value(requestKeysKey{}).(map[string]interface{}); ok {
+		for k, v := range previous {
+			merged[k] = v
+		}
+	}
+	for k, v := range keys {
+		merged[k] = v
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestKeysKey{}, merged))
+}
+
+// requestKeys returns the session keys of an http request, its headers
+// overridden by the keys set with WithRequestKeys and then by the keys
+// returned by the authenticator.
+func requestKeys(r *http.Request, authenticated map[string]interface{}) map[string]interface{} {
+	keys := map[string]interface{}{}
+	for k, v := range r.Header {
+		keys[k] = v
+	}
+	if values, ok := r.Context().Value(requestKeysKey{}).(map[string]interface{}); ok {
+		for k, v := range values {
+			keys[k] = v
+		}
+	}
+	for k, v := range authenticated {
+		keys[k] = v
+	}
+	return keys
+}
+
+// ServeHTTP serves websocket sessions with the default options of HandleGws,
+// so m can be mounted on any http router. The default options accept any
+// Origin, use Handler with WithGwsOrigins to only accept the upgrades of pages
+// served by trusted origins.
+func (m *Comet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Handler returns an http.Handler serving websocket sessions like HandleGws
+// with options.
+func (m *Comet) Handler(options ...GwsOption) http.Handler {
+	return HandleGws(m, options...)
+}
+
 // HandleClose sets the handler for close messages received from the session.
 // The code argument to h is the received close code or CloseNoStatusReceived
 // if the close message is empty. The default close handler sends a close frame
@@ -109,17 +300,61 @@ func (m *Comet) HandleClose(fn func(*Session, int, string) error) {
 }
 
 // Handle keep websocket or tcp connections and dispatches them to be handled by the comet instance.
-func (m *Comet) Handle(conn Conn, keys map[string]interface{}) {
-	session := &Session{
-		keys:    keys,
-		conn:    conn,
-		buffer:  NewRingBuffer(m.Config.MessageBufferSize),
-		comet:   m,
-		open:    true,
-		rwmutex: &sync.RWMutex{},
+// After Shutdown began, conn is closed with a going away close frame and ErrServerClosed is returned.
+func (m *Comet) Handle(conn Conn, keys map[string]interface{}) error {
+	return m.HandleContext(context.Background(), conn, keys)
+}
+
+// HandleContext is like Handle, the session context is derived from ctx.
+func (m *Comet) HandleContext(ctx context.Context, conn Conn, keys map[string]interface{}) error {
+	return m.handle(m.newSession(ctx, conn, NewHandshake(conn, nil), keys))
+}
+
+// HandleHandshake is like Handle, the session exposes handshake through Session.Handshake
+// and Session.Request and its context is derived from the handshake request context.
+func (m *Comet) HandleHandshake(conn Conn, handshake *Handshake, keys map[string]interface{}) error {
+	return m.handle(m.newSession(handshake.context(), conn, handshake, keys))
+}
+
+func (m *Comet) handle(session *Session) error {
+	if !m.sessions.add(session) {
+		_ = session.conn.SetWriteDeadline(time.Now().Add(m.Config.WriteWait))
+		_ = session.conn.WriteMessage(CloseMessage, FormatCloseMessage(CloseGoingAway, "server shutdown"))
+		_ = session.conn.Close()
+		session.cancel(ErrServerClosed)
+		return ErrServerClosed
 	}
 
-	m.connectHandler(session)
+	m.serve(session)
+	m.sessions.remove(session)
+	return nil
+}
+
+func (m *Comet) newSession(ctx context.Context, conn Conn, handshake *Handshake, keys map[string]interface{}) *Session {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Session{
+		seq:       atomic.AddUint64(&sessionSeq, 1),
+		id:        m.Config.SessionID(handshake),
+		handshake: handshake,
+		keys:      keys,
+		conn:      conn,
+		buffer:    NewRingBuffer(m.Config.MessageBufferSize),
+		comet:     m,
+		open:      true,
+		rwmutex:   &sync.RWMutex{},
+		flushed:   make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// serve runs the session pumps and returns once both of them exited.
+func (m *Comet) serve(session *Session) {
+	if compressor, ok := session.conn.(Compressor); ok && session.compression() {
+		_ = compressor.SetCompressionLevel(m.Config.CompressLevel)
+	}
+
+	m.handleConnect(session)
 
 	go session.writePump()
 
@@ -127,5 +362,24 @@ func (m *Comet) Handle(conn Conn, keys map[string]interface{}) {
 
 	session.close()
 
-	m.disconnectHandler(session)
+	<-session.flushed
+
+	m.handleDisconnect(session)
+}
+
+// Shutdown rejects new sessions, sends a going away close frame to every session
+// and waits until their write pumps flushed and they disconnected. If ctx is done
+// first, the remaining sessions are closed and reported in a *ShutdownError.
+func (m *Comet) Shutdown(ctx context.Context) error {
+	return m.sessions.shutdown(ctx, FormatCloseMessage(CloseGoingAway, "server shutdown"))
+}
+
+// Sessions returns the sessions currently handled by the comet instance.
+func (m *Comet) Sessions() []*Session {
+	return m.sessions.list()
+}
+
+// Len returns the number of sessions currently handled by the comet instance.
+func (m *Comet) Len() int {
+	return m.sessions.len()
 }
@@ -1,12 +1,33 @@
 package comet
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -15,29 +36,30 @@ import (
 )
 
 type TestServer struct {
-	m *Comet
-	h *Hub
+	m       *Comet
+	h       *Hub
+	options []GwsOption
 }
 
 func NewTestServerHandler(handler handleMessageFunc) *TestServer {
-	m := New()
-	h := NewHub()
-	m.HandleMessage(handler)
-	return &TestServer{
-		m: m,
-		h: h,
-	}
+	s := NewTestServer()
+	s.m.HandleMessage(handler)
+	return s
 }
 
 func NewTestServer() *TestServer {
 	m := New()
+	h := NewHub()
+	m.HandleConnect(h.Register)
+	m.HandleDisconnect(h.Unregister)
 	return &TestServer{
 		m: m,
+		h: h,
 	}
 }
 
 func (s *TestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_ = HandleRequest(s.m)(w, r)
+	_ = HandleGws(s.m, s.options...)(w, r)
 }
 
 func NewDialer(url string) (*websocket.Conn, error) {
@@ -46,6 +68,67 @@ func NewDialer(url string) (*websocket.Conn, error) {
 	return conn, err
 }
 
+// nopConn is a Conn that records writes and blocks reads until it is closed.
+type nopConn struct {
+	closed chan struct{}
+	once   sync.Once
+	mutex  sync.Mutex
+	frames []*envelope
+}
+
+func newNopConn() *nopConn {
+	return &nopConn{closed: make(chan struct{})}
+}
+
+func (c *nopConn) LocalAddr() net.Addr                     { return nil }
+func (c *nopConn) RemoteAddr() net.Addr                    { return nil }
+func (c *nopConn) SetWriteDeadline(time.Time) error        { return nil }
+func (c *nopConn) SetReadLimit(int64)                      {}
+func (c *nopConn) SetReadDeadline(time.Time) error         { return nil }
+func (c *nopConn) SetPongHandler(func(string) error)       {}
+func (c *nopConn) SetPingHandler(func(string) error)       {}
+func (c *nopConn) SetCloseHandler(func(int, string) error) {}
+
+func (c *nopConn) WriteMessage(t int, msg []byte) error {
+	c.mutex.Lock()
+	c.frames = append(c.frames, &envelope{t: t, msg: msg})
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *nopConn) written() []*envelope {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*envelope{}, c.frames...)
+}
+
+func (c *nopConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return NoFrame, nil, errors.New("nop conn closed")
+}
+
+func (c *nopConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func newTestSession(m *Comet) *Session {
+	conn := newNopConn()
+	return m.newSession(context.Background(), conn, NewHandshake(conn, nil), nil)
+}
+
+// queued drains the message buffer of a session whose write pump is not running.
+func queued(s *Session) []string {
+	var msgs []string
+	for {
+		m, _ := s.buffer.Shift()
+		if m == nil {
+			return msgs
+		}
+		msgs = append(msgs, string(s.dequeued(m).msg))
+	}
+}
+
 func TestEcho(t *testing.T) {
 	echo := NewTestServerHandler(func(session *Session, msg []byte) {
 		session.Write(msg)
@@ -88,6 +171,13 @@ func TestWriteClosed(t *testing.T) {
 	echo := NewTestServerHandler(func(session *Session, msg []byte) {
 		session.Write(msg)
 	})
+	errs := make(chan error, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		s.Close()
+	})
+	echo.m.HandleDisconnect(func(s *Session) {
+		errs <- s.Write([]byte("hello world"))
+	})
 	server := httptest.NewServer(echo)
 	defer server.Close()
 
@@ -98,20 +188,24 @@ func TestWriteClosed(t *testing.T) {
 			t.Error(err)
 			return false
 		}
+		defer conn.Close()
 
 		conn.WriteMessage(websocket.TextMessage, []byte(msg))
 
-		echo.m.HandleConnect(func(s *Session) {
-			s.Close()
-		})
-
-		echo.m.HandleDisconnect(func(s *Session) {
-			err := s.Write([]byte("hello world"))
+		// reading answers the close frame of the session
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
 
+		select {
+		case err := <-errs:
 			if err == nil {
 				t.Error("should be an error")
 			}
-		})
+		case <-time.After(time.Second):
+			t.Error("session should disconnect")
+			return false
+		}
 
 		return true
 	}
@@ -281,400 +375,3641 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
-func TestUpgrader(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
-		session.Write(msg)
-	})
-	server := httptest.NewServer(broadcast)
-	defer server.Close()
+func TestKeys(t *testing.T) {
+	s := newTestSession(New())
+	now := time.Now()
+	s.Set("string", "test")
+	s.Set("bool", true)
+	s.Set("int", 42)
+	s.Set("int64", int64(42))
+	s.Set("float64", 4.2)
+	s.Set("time", now)
+	s.Set("duration", time.Second)
+	s.Set("strings", []string{"a", "b"})
+
+	if v := s.GetString("string"); v != "test" {
+		t.Errorf("string %q should equal test", v)
+	}
+	if v := s.GetBool("bool"); !v {
+		t.Error("bool should be true")
+	}
+	if v := s.GetInt("int"); v != 42 {
+		t.Errorf("int %d should equal 42", v)
+	}
+	if v := s.GetInt64("int64"); v != 42 {
+		t.Errorf("int64 %d should equal 42", v)
+	}
+	if v := s.GetFloat64("float64"); v != 4.2 {
+		t.Errorf("float64 %f should equal 4.2", v)
+	}
+	if v := s.GetTime("time"); !v.Equal(now) {
+		t.Errorf("time %v should equal %v", v, now)
+	}
+	if v := s.GetDuration("duration"); v != time.Second {
+		t.Errorf("duration %v should equal 1s", v)
+	}
+	if v := s.GetStringSlice("strings"); len(v) != 2 {
+		t.Errorf("strings %v should have 2 elements", v)
+	}
 
-	broadcast.m.HandleError(func(session *Session, err error) {
-		if err == nil || err.Error() != "websocket: origin not allowed" {
-			t.Error("there should be a origin error")
-		}
-	})
+	if v := s.GetInt("string"); v != 0 {
+		t.Errorf("int of a string %d should equal 0", v)
+	}
+	if v, ok := Value[int](s, "string"); ok || v != 0 {
+		t.Errorf("value of the wrong type should not be found, got %d", v)
+	}
+	if v, ok := Value[string](s, "string"); !ok || v != "test" {
+		t.Errorf("value %q should equal test", v)
+	}
 
-	_, err := NewDialer(server.URL)
+	keys := s.Keys()
+	if len(keys) != 8 {
+		t.Errorf("keys %v should have 8 entries", keys)
+	}
+	keys["string"] = "changed"
+	s.Delete("int")
+	if _, ok := s.Get("int"); ok {
+		t.Error("deleted key should not exist")
+	}
+	if v := s.GetString("string"); v != "test" {
+		t.Errorf("keys should be a copy, got %q", v)
+	}
+}
 
-	if err == nil || err.Error() != "websocket: bad handshake" {
-		t.Error("there should be a badhandshake error")
+func TestKeysConcurrent(t *testing.T) {
+	s := newTestSession(New())
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i % 2)
+			for n := 0; n < 100; n++ {
+				s.Set(key, n)
+				s.GetInt(key)
+				s.Keys()
+				s.Delete(key)
+			}
+		}(i)
 	}
+	wg.Wait()
 }
 
-func TestBroadcast(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
-		broadcast.h.Broadcast(msg)
+type chatSend struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+func TestEvents(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(append([]byte("raw "), msg...))
 	})
-	server := httptest.NewServer(broadcast)
+	echo.m.On("chat.send", func(s *Session, payload chatSend) error {
+		return s.Emit("chat.sent", payload)
+	})
+	echo.m.On("chat.pointer", func(s *Session, payload *chatSend) error {
+		return s.Emit("chat.sent", payload)
+	})
+	echo.m.On("fail", func(s *Session, payload struct{}) error {
+		return errors.New("failed")
+	})
+	server := httptest.NewServer(echo)
 	defer server.Close()
 
-	n := 10
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-	fn := func(msg string) bool {
-		conn, _ := NewDialer(server.URL)
-		defer conn.Close()
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`{"event":"chat.send","data":{"room":"a","text":"hi"}}`, `{"event":"chat.sent","data":{"room":"a","text":"hi"}}`},
+		{`{"event":"chat.pointer","data":{"room":"b","text":"hi"}}`, `{"event":"chat.sent","data":{"room":"b","text":"hi"}}`},
+		{`{"event":"chat.send","data":"invalid"}`, `{"event":"error","data":{"event":"chat.send","error":"json: cannot unmarshal string into Go value of type comet.chatSend"}}`},
+		{`{"event":"fail"}`, `{"event":"error","data":{"event":"fail","error":"failed"}}`},
+		{`{"event":"unknown"}`, `raw {"event":"unknown"}`},
+		{`hello`, `raw hello`},
+	}
 
-		listeners := make([]*websocket.Conn, n)
-		for i := 0; i < n; i++ {
-			listener, _ := NewDialer(server.URL)
-			listeners[i] = listener
-			defer listeners[i].Close()
+	for _, test := range tests {
+		conn.WriteMessage(websocket.TextMessage, []byte(test.msg))
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		conn.WriteMessage(websocket.TextMessage, []byte(msg))
-
-		for i := 0; i < n; i++ {
-			_, ret, err := listeners[i].ReadMessage()
-
-			if err != nil {
-				t.Error(err)
-				return false
-			}
-
-			if msg != string(ret) {
-				t.Errorf("%s should equal %s", msg, string(ret))
-				return false
-			}
+		if string(ret) != test.want {
+			t.Errorf("reply to %s should equal %s, got %s", test.msg, test.want, ret)
 		}
+	}
+}
 
-		return true
+func TestEventsWithMessageHandler(t *testing.T) {
+	m := New()
+	var raw []string
+	m.HandleMessage(func(s *Session, msg []byte) {
+		raw = append(raw, string(msg))
+	})
+	var errs []error
+	m.HandleEventError(func(s *Session, event string, err error) {
+		errs = append(errs, err)
+	})
+	events := 0
+	m.On("test", func(s *Session, payload int) error {
+		events++
+		return nil
+	})
+
+	s := newTestSession(m)
+	msgs := []string{`{"event":"test","data":1}`, `{"event":"status","data":"online"}`, `hello`}
+	for _, msg := range msgs {
+		m.dispatch(s, []byte(msg))
 	}
 
-	if !fn("test") {
-		t.Errorf("should not be false")
+	if events != 1 {
+		t.Errorf("event handler should be called once, got %d", events)
+	}
+	if len(raw) != 2 || raw[0] != msgs[1] || raw[1] != msgs[2] {
+		t.Errorf("message handler should get the messages without an event handler, got %v", raw)
+	}
+	if len(errs) != 0 {
+		t.Errorf("events without a handler should not be errors with a message handler, got %v", errs)
 	}
 }
 
-func TestBroadcastBinary(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
-		broadcast.h.BroadcastBinary(msg)
+func TestEventErrorHandler(t *testing.T) {
+	m := New()
+	var errs []error
+	m.HandleEventError(func(s *Session, event string, err error) {
+		errs = append(errs, err)
+	})
+	m.On("test", func(s *Session, payload int) error {
+		return nil
 	})
-	server := httptest.NewServer(broadcast)
-	defer server.Close()
 
-	n := 10
+	s := newTestSession(m)
+	m.dispatch(s, []byte(`{"event":"test","data":1}`))
+	m.dispatch(s, []byte(`{"event":"unknown"}`))
 
-	fn := func(msg []byte) bool {
-		conn, _ := NewDialer(server.URL)
-		defer conn.Close()
+	if len(errs) != 1 || errs[0] != ErrUnknownEvent {
+		t.Errorf("errors %v should only contain %v", errs, ErrUnknownEvent)
+	}
+	if msgs := queued(s); len(msgs) != 0 {
+		t.Errorf("custom event error handler should not reply, got %v", msgs)
+	}
 
-		listeners := make([]*websocket.Conn, n)
-		for i := 0; i < n; i++ {
-			listener, _ := NewDialer(server.URL)
-			listeners[i] = listener
-			defer listeners[i].Close()
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a handler with the wrong signature should panic")
 		}
+	}()
+	m.On("invalid", func(payload int) {})
+}
 
-		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
+func TestCall(t *testing.T) {
+	srv := NewTestServer()
+	sessions := make(chan *Session, 1)
+	srv.m.HandleConnect(func(s *Session) {
+		sessions <- s
+	})
+	server := httptest.NewServer(srv)
+	defer server.Close()
 
-		for i := 0; i < n; i++ {
-			messageType, ret, err := listeners[i].ReadMessage()
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
+	// the client answers confirm with the negated params and fails other methods
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
 			if err != nil {
-				t.Error(err)
-				return false
+				return
 			}
-
-			if messageType != websocket.BinaryMessage {
-				t.Errorf("message type should be BinaryMessage")
-				return false
+			var call struct {
+				Event string
+				Data  struct {
+					ID     uint64
+					Method string
+					Params bool
+				}
 			}
-
-			if !bytes.Equal(msg, ret) {
-				t.Errorf("%v should equal %v", msg, ret)
-				return false
+			json.Unmarshal(msg, &call)
+			switch call.Data.Method {
+			case "confirm":
+				conn.WriteJSON(map[string]interface{}{"event": ResultEvent, "data": map[string]interface{}{"id": call.Data.ID, "result": !call.Data.Params}})
+			case "fail":
+				conn.WriteJSON(map[string]interface{}{"event": ResultEvent, "data": map[string]interface{}{"id": call.Data.ID, "error": "failed"}})
 			}
 		}
+	}()
 
-		return true
+	s := <-sessions
+	result, err := s.Call(context.Background(), "confirm", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "false" {
+		t.Errorf("result %s should equal false", result)
 	}
 
-	if !fn([]byte{2, 3, 5, 7, 11}) {
-		t.Errorf("should not be false")
+	_, err = s.Call(context.Background(), "fail", nil)
+	var callErr *CallError
+	if !errors.As(err, &callErr) || callErr.Message != "failed" {
+		t.Errorf("error %v should be a call error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Call(ctx, "ignore", nil); err != context.DeadlineExceeded {
+		t.Errorf("error %v should equal %v", err, context.DeadlineExceeded)
+	}
+	if pending := s.pending(); pending != 0 {
+		t.Errorf("pending calls %d should equal 0", pending)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Call(context.Background(), "ignore", nil)
+		done <- err
+	}()
+	for s.pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.close()
+	if err := <-done; err != ErrSessionClosed {
+		t.Errorf("error %v should equal %v", err, ErrSessionClosed)
 	}
 }
 
-func TestBroadcastOthers(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
-		broadcast.h.BroadcastOthers(msg, session)
+func TestCallOnConnect(t *testing.T) {
+	srv := NewTestServer()
+	results := make(chan string, 1)
+	srv.m.HandleConnect(func(s *Session) {
+		go func() {
+			result, err := s.Call(s.Context(), "probe", nil)
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- string(result)
+		}()
 	})
-	broadcast.m.Config.PongWait = time.Second
-	broadcast.m.Config.PingPeriod = time.Second * 9 / 10
-	server := httptest.NewServer(broadcast)
+	server := httptest.NewServer(srv)
 	defer server.Close()
 
-	n := 10
-
-	fn := func(msg string) bool {
-		conn, _ := NewDialer(server.URL)
-		defer conn.Close()
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-		listeners := make([]*websocket.Conn, n)
-		for i := 0; i < n; i++ {
-			listener, _ := NewDialer(server.URL)
-			listeners[i] = listener
-			defer listeners[i].Close()
+	var call struct {
+		Data struct {
+			ID uint64
 		}
+	}
+	if err := conn.ReadJSON(&call); err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteJSON(map[string]interface{}{"event": ResultEvent, "data": map[string]interface{}{"id": call.Data.ID, "result": "ok"}})
 
-		conn.WriteMessage(websocket.TextMessage, []byte(msg))
-
-		for i := 0; i < n; i++ {
-			_, ret, err := listeners[i].ReadMessage()
+	select {
+	case result := <-results:
+		if result != `"ok"` {
+			t.Errorf("result %s should equal \"ok\"", result)
+		}
+	case <-time.After(time.Second):
+		t.Error("call should be answered")
+	}
+}
 
-			if err != nil {
-				t.Error(err)
-				return false
-			}
+func TestNewMethod(t *testing.T) {
+	tests := []struct {
+		fn    interface{}
+		valid bool
+	}{
+		{func(s *Session, params []int) (int, error) { return 0, nil }, true},
+		{func(s *Session, params struct{}) (interface{}, error) { return nil, nil }, true},
+		{func(s *Session, params int) error { return nil }, false},
+		{func(params int) (int, error) { return 0, nil }, false},
+		{func(s *Session, params int) (int, bool) { return 0, false }, false},
+		{"add", false},
+		{nil, false},
+	}
 
-			if msg != string(ret) {
-				t.Errorf("%s should equal %s", msg, string(ret))
-				return false
-			}
+	for _, test := range tests {
+		if _, err := NewMethod(test.fn); (err == nil) != test.valid {
+			t.Errorf("method %T should be valid %v, got %v", test.fn, test.valid, err)
 		}
-
-		return true
 	}
 
-	if !fn("test") {
-		t.Errorf("should not be false")
+	method, _ := NewMethod(func(s *Session, params []int) (int, error) {
+		return params[0] + params[1], nil
+	})
+	result, err := method.Call(newTestSession(New()), func(v interface{}) error {
+		return json.Unmarshal([]byte("[1,2]"), v)
+	})
+	if err != nil || result != 3 {
+		t.Errorf("method result %v, %v should equal 3", result, err)
 	}
 }
 
-func TestBroadcastBinaryOthers(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
-		broadcast.h.BroadcastBinaryOthers(msg, session)
+func TestOnCall(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.OnCall("add", func(s *Session, params []int) (int, error) {
+		sum := 0
+		for _, n := range params {
+			sum += n
+		}
+		return sum, nil
 	})
-	broadcast.m.Config.PongWait = time.Second
-	broadcast.m.Config.PingPeriod = time.Second * 9 / 10
-	server := httptest.NewServer(broadcast)
+	server := httptest.NewServer(echo)
 	defer server.Close()
 
-	n := 10
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-	fn := func(msg []byte) bool {
-		conn, _ := NewDialer(server.URL)
-		defer conn.Close()
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`{"event":"rpc.call","data":{"id":1,"method":"add","params":[1,2,3]}}`, `{"event":"rpc.result","data":{"id":1,"result":6}}`},
+		{`{"event":"rpc.call","data":{"id":2,"method":"add","params":"invalid"}}`, `{"event":"rpc.result","data":{"id":2,"error":"json: cannot unmarshal string into Go value of type []int"}}`},
+		{`{"event":"rpc.call","data":{"id":3,"method":"sub"}}`, `{"event":"rpc.result","data":{"id":3,"error":"comet: unknown method"}}`},
+	}
 
-		listeners := make([]*websocket.Conn, n)
-		for i := 0; i < n; i++ {
-			listener, _ := NewDialer(server.URL)
-			listeners[i] = listener
-			defer listeners[i].Close()
+	for _, test := range tests {
+		conn.WriteMessage(websocket.TextMessage, []byte(test.msg))
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
 		}
+		if string(ret) != test.want {
+			t.Errorf("reply to %s should equal %s, got %s", test.msg, test.want, ret)
+		}
+	}
+}
 
-		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
-
-		for i := 0; i < n; i++ {
-			messageType, ret, err := listeners[i].ReadMessage()
+func TestMiddleware(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if string(msg) == "panic" {
+			panic("test")
+		}
+		session.Write(msg)
+	})
+	echo.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	errs := make(chan error, 1)
+	echo.m.HandleError(func(s *Session, err error) {
+		errs <- err
+	})
 
-			if err != nil {
-				t.Error(err)
-				return false
+	mark := func(name string) Middleware {
+		return func(next func(*Session, []byte)) func(*Session, []byte) {
+			return func(s *Session, msg []byte) {
+				next(s, append(msg, name...))
+			}
+		}
+	}
+	deny := func(next func(*Session, []byte)) func(*Session, []byte) {
+		return func(s *Session, msg []byte) {
+			if strings.HasPrefix(string(msg), "deny") {
+				s.Write([]byte("denied"))
+				return
 			}
+			next(s, msg)
+		}
+	}
+	echo.m.Use(Recover(), deny, mark(" a"))
+	echo.m.Use(mark(" b"))
 
-			if messageType != websocket.BinaryMessage {
-				t.Errorf("message type should be BinaryMessage")
-				return false
+	server := httptest.NewServer(echo)
+	defer server.Close()
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		t    int
+		msg  string
+		want string
+	}{
+		{websocket.TextMessage, "test", "test a b"},
+		{websocket.BinaryMessage, "test", "test a b"},
+		{websocket.TextMessage, "deny", "denied"},
+	}
+	for _, test := range tests {
+		conn.WriteMessage(test.t, []byte(test.msg))
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != test.want {
+			t.Errorf("reply to %s should equal %s, got %s", test.msg, test.want, ret)
+		}
+	}
+
+	echo.m.Use(func(next func(*Session, []byte)) func(*Session, []byte) {
+		return func(s *Session, msg []byte) {
+			next(s, []byte("panic"))
+		}
+	})
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("recovered panic should be reported, got %v", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var mutex sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mutex.Lock()
+		calls = append(calls, call)
+		mutex.Unlock()
+	}
+
+	srv := NewTestServer()
+	srv.m.HookConnect(func(*Session) { record("hook connect 1") })
+	srv.m.HookConnect(func(*Session) { record("hook connect 2") })
+	srv.m.HandleConnect(func(*Session) { record("connect") })
+	srv.m.HandleDisconnect(func(*Session) { record("disconnect") })
+	srv.m.HookDisconnect(func(*Session) { record("hook disconnect") })
+	srv.m.HandleError(func(*Session, error) { record("error") })
+	srv.m.HookError(func(*Session, error) { record("hook error") })
+
+	done := make(chan struct{})
+	srv.m.HookDisconnect(func(*Session) { close(done) })
+
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-done
+
+	want := []string{"hook connect 1", "hook connect 2", "connect", "error", "hook error", "disconnect", "hook disconnect"}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls %v should equal %v", calls, want)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	echo := NewTestServer()
+	handshakes := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		handshakes <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	header := http.Header{"X-Test": []string{"test"}}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/chat/room?id=42", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	session := <-handshakes
+	handshake := session.Handshake()
+
+	if session.Request() == nil || session.Request().URL.Path != "/chat/room" {
+		t.Error("session request should be the upgraded http request")
+	}
+
+	if handshake.Path != "/chat/room" || handshake.Query.Get("id") != "42" || handshake.Header.Get("X-Test") != "test" {
+		t.Errorf("handshake should be populated from the request, got %+v", handshake)
+	}
+
+	if handshake.RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("handshake remote addr %s should equal %s", handshake.RemoteAddr, conn.LocalAddr())
+	}
+}
+
+func TestTCPHandshake(t *testing.T) {
+	m := New()
+	handshakes := make(chan *Session, 1)
+	m.HandleConnect(func(session *Session) {
+		handshakes <- session
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	session := <-handshakes
+	handshake := session.Handshake()
+
+	if session.Request() != nil {
+		t.Error("tcp sessions should not have a request")
+	}
+
+	if handshake.Path != "" || handshake.Query == nil || handshake.Header == nil {
+		t.Errorf("tcp handshake should have an empty path, query and header, got %+v", handshake)
+	}
+
+	if handshake.RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("handshake remote addr %s should equal %s", handshake.RemoteAddr, conn.LocalAddr())
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	isCloseError := func(code int) func(error) bool {
+		return func(err error) bool {
+			var closeErr *websocket.CloseError
+			return errors.As(err, &closeErr) && closeErr.Code == code
+		}
+	}
+	is := func(target error) func(error) bool {
+		return func(err error) bool {
+			return errors.Is(err, target)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		close func(*TestServer, *Session, *websocket.Conn)
+		cause func(error) bool
+	}{
+		{"close frame", func(_ *TestServer, _ *Session, conn *websocket.Conn) {
+			conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseNormalClosure, ""))
+		}, isCloseError(CloseNormalClosure)},
+		{"read error", func(_ *TestServer, _ *Session, conn *websocket.Conn) {
+			conn.Close()
+		}, isCloseError(websocket.CloseAbnormalClosure)},
+		{"session close", func(_ *TestServer, s *Session, _ *websocket.Conn) {
+			s.Close()
+		}, is(ErrSessionClosed)},
+		{"hub close", func(srv *TestServer, _ *Session, _ *websocket.Conn) {
+			srv.h.Close()
+		}, is(ErrHubClosed)},
+		{"shutdown", func(srv *TestServer, _ *Session, _ *websocket.Conn) {
+			go srv.m.Shutdown(context.Background())
+		}, is(ErrServerClosed)},
+	}
+
+	for _, test := range tests {
+		srv := NewTestServer()
+		sessions := make(chan *Session, 1)
+		srv.m.HandleConnect(func(s *Session) {
+			srv.h.Register(s)
+			sessions <- s
+		})
+		server := httptest.NewServer(srv)
+
+		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
 			}
+		}()
 
-			if !bytes.Equal(msg, ret) {
-				t.Errorf("%v should equal %v", msg, ret)
-				return false
+		s := <-sessions
+		if err := s.Context().Err(); err != nil {
+			t.Fatalf("%s: context of an open session should not be done, got %v", test.name, err)
+		}
+
+		test.close(srv, s, conn)
+		select {
+		case <-s.Context().Done():
+			if cause := context.Cause(s.Context()); !test.cause(cause) {
+				t.Errorf("%s: unexpected context cause %v", test.name, cause)
 			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: context should be done", test.name)
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestHandleContext(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "test"))
+
+	m := New()
+	sessions := make(chan *Session, 1)
+	m.HandleConnect(func(s *Session) {
+		sessions <- s
+	})
+	conn := newNopConn()
+	done := make(chan error)
+	go func() {
+		done <- m.HandleContext(ctx, conn, nil)
+	}()
+
+	s := <-sessions
+	if v := s.Context().Value(key{}); v != "test" {
+		t.Errorf("session context value %v should come from the parent context", v)
+	}
+
+	cancel()
+	<-s.Context().Done()
+	if cause := context.Cause(s.Context()); cause != context.Canceled {
+		t.Errorf("context cause %v should equal %v", cause, context.Canceled)
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgrader(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	broadcast.options = append(broadcast.options, WithGwsCheckOrigin(func(r *http.Request) bool {
+		return false
+	}))
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	broadcast.m.HandleError(func(session *Session, err error) {
+		if err == nil || err.Error() != "websocket: origin not allowed" {
+			t.Error("there should be a origin error")
+		}
+	})
+
+	_, err := NewDialer(server.URL)
+
+	if err == nil || err.Error() != "websocket: bad handshake" {
+		t.Error("there should be a badhandshake error")
+	}
+}
+
+func TestGwsOrigins(t *testing.T) {
+	echo := NewTestServer()
+	echo.options = append(echo.options, WithGwsOrigins("https://example.com"))
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	dialer := &websocket.Dialer{}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"https://evil.com", false},
+		{"http://example.com", false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+
+		conn, resp, err := dialer.Dial(url, header)
+		if test.allowed && err != nil {
+			t.Errorf("origin %q should be allowed, got %v", test.origin, err)
+		}
+		if !test.allowed && (err == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q should be forbidden", test.origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestGwsSubprotocols(t *testing.T) {
+	echo := NewTestServer()
+	echo.options = append(echo.options, WithGwsSubprotocols("v2", "v1"))
+	handshakes := make(chan *Handshake, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		handshakes <- s.Handshake()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"v1", "v2"}}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != "v2" {
+		t.Errorf("negotiated subprotocol %s should equal v2", conn.Subprotocol())
+	}
+
+	if handshake := <-handshakes; handshake.Subprotocol != "v2" {
+		t.Errorf("handshake subprotocol %s should equal v2", handshake.Subprotocol)
+	}
+}
+
+func TestGwsErrorResponse(t *testing.T) {
+	echo := NewTestServer()
+	echo.options = append(echo.options,
+		WithGwsOrigins("https://example.com"),
+		WithGwsErrorResponse(func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			w.Header().Set("X-Reason", reason.Error())
+			w.WriteHeader(status)
+		}),
+	)
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	header := http.Header{"Origin": []string{"https://evil.com"}}
+	_, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), header)
+	if err == nil {
+		t.Fatal("origin should be rejected")
+	}
+
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Reason") == "" {
+		t.Errorf("custom error response should be written, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestGwsCompression(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.options = append(echo.options, WithGwsCompression(true), WithGwsWriteBufferPool(&sync.Pool{}))
+	echo.m.Config.MaxMessageSize = 1 << 16
+	handshakes := make(chan *Handshake, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		handshakes <- s.Handshake()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Error("permessage-deflate should be negotiated")
+	}
+
+	if handshake := <-handshakes; !handshake.Compression {
+		t.Error("handshake should report the negotiated compression")
+	}
+
+	msg := strings.Repeat("test", 1024)
+	conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != msg {
+		t.Errorf("compressed echo should round trip, got %v", err)
+	}
+}
+
+func authenticateToken(r *http.Request) (map[string]interface{}, error) {
+	switch r.Header.Get("Authorization") {
+	case "":
+		return nil, ErrUnauthorized
+	case "valid":
+		return map[string]interface{}{"user": "42"}, nil
+	default:
+		return nil, fmt.Errorf("token %w", ErrForbidden)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleAuthenticate(authenticateToken)
+	echo.m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write([]byte(session.MustGet("user").(string)))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	dialer := &websocket.Dialer{}
+
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"invalid", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		header := http.Header{"Authorization": []string{test.token}}
+		_, resp, err := dialer.Dial(url, header)
+		if err == nil || resp.StatusCode != test.status {
+			t.Errorf("token %q should be rejected with %d", test.token, test.status)
+		}
+	}
+
+	if echo.m.Len() != 0 {
+		t.Error("rejected requests should not become sessions")
+	}
+
+	conn, _, err := dialer.Dial(url, http.Header{"Authorization": []string{"valid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "42" {
+		t.Errorf("authenticator keys should seed the session keys, got %s %v", ret, err)
+	}
+}
+
+func TestTCPAuthenticate(t *testing.T) {
+	m := New()
+	m.HandleAuthenticate(authenticateToken)
+	m.HandleMessage(func(session *Session, msg []byte) {
+		handshake := session.Handshake()
+		session.Write([]byte(session.MustGet("user").(string) + handshake.Path + handshake.Query.Get("id")))
+	})
+
+	srv, err := ListenTCP(m, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Shutdown(context.Background())
+
+	addr := srv.Addr().String()
+
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"invalid", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		header := http.Header{"Authorization": []string{test.token}}
+		_, resp, err := DialTCPHandshake(addr, "/chat", header)
+		if err != ErrBadHandshake || resp.StatusCode != test.status {
+			t.Errorf("token %q should be rejected with %d, got %v", test.token, test.status, err)
+		}
+	}
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(TextMessage, []byte("test"))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("connections without a handshake frame should be rejected")
+	}
+	conn.Close()
+
+	conn, resp, err := DialTCPHandshake(addr, "/chat?id=1", http.Header{"Authorization": []string{"valid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("handshake status %d should equal 101", resp.StatusCode)
+	}
+
+	conn.WriteMessage(TextMessage, []byte("test"))
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "42/chat1" {
+		t.Errorf("handshake should seed the session keys and handshake, got %s %v", ret, err)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		broadcast.h.Broadcast(msg)
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	n := 10
+
+	fn := func(msg string) bool {
+		conn, _ := NewDialer(server.URL)
+		defer conn.Close()
+
+		listeners := make([]*websocket.Conn, n)
+		for i := 0; i < n; i++ {
+			listener, _ := NewDialer(server.URL)
+			listeners[i] = listener
+			defer listeners[i].Close()
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+		for i := 0; i < n; i++ {
+			_, ret, err := listeners[i].ReadMessage()
+
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			if msg != string(ret) {
+				t.Errorf("%s should equal %s", msg, string(ret))
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !fn("test") {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestBroadcastBinary(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastBinary(msg)
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	n := 10
+
+	fn := func(msg []byte) bool {
+		conn, _ := NewDialer(server.URL)
+		defer conn.Close()
+
+		listeners := make([]*websocket.Conn, n)
+		for i := 0; i < n; i++ {
+			listener, _ := NewDialer(server.URL)
+			listeners[i] = listener
+			defer listeners[i].Close()
+		}
+
+		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
+
+		for i := 0; i < n; i++ {
+			messageType, ret, err := listeners[i].ReadMessage()
+
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			if messageType != websocket.BinaryMessage {
+				t.Errorf("message type should be BinaryMessage")
+				return false
+			}
+
+			if !bytes.Equal(msg, ret) {
+				t.Errorf("%v should equal %v", msg, ret)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !fn([]byte{2, 3, 5, 7, 11}) {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestBroadcastOthers(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastOthers(msg, session)
+	})
+	broadcast.m.Config.PongWait = time.Second
+	broadcast.m.Config.PingPeriod = time.Second * 9 / 10
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	n := 10
+
+	fn := func(msg string) bool {
+		conn, _ := NewDialer(server.URL)
+		defer conn.Close()
+
+		listeners := make([]*websocket.Conn, n)
+		for i := 0; i < n; i++ {
+			listener, _ := NewDialer(server.URL)
+			listeners[i] = listener
+			defer listeners[i].Close()
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+		for i := 0; i < n; i++ {
+			_, ret, err := listeners[i].ReadMessage()
+
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			if msg != string(ret) {
+				t.Errorf("%s should equal %s", msg, string(ret))
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !fn("test") {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestBroadcastBinaryOthers(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastBinaryOthers(msg, session)
+	})
+	broadcast.m.Config.PongWait = time.Second
+	broadcast.m.Config.PingPeriod = time.Second * 9 / 10
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	n := 10
+
+	fn := func(msg []byte) bool {
+		conn, _ := NewDialer(server.URL)
+		defer conn.Close()
+
+		listeners := make([]*websocket.Conn, n)
+		for i := 0; i < n; i++ {
+			listener, _ := NewDialer(server.URL)
+			listeners[i] = listener
+			defer listeners[i].Close()
+		}
+
+		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
+
+		for i := 0; i < n; i++ {
+			messageType, ret, err := listeners[i].ReadMessage()
+
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			if messageType != websocket.BinaryMessage {
+				t.Errorf("message type should be BinaryMessage")
+				return false
+			}
+
+			if !bytes.Equal(msg, ret) {
+				t.Errorf("%v should equal %v", msg, ret)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if !fn([]byte{2, 3, 5, 7, 11}) {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	noecho := NewTestServer()
+	noecho.m.Config.PongWait = time.Second
+	noecho.m.Config.PingPeriod = time.Second * 9 / 10
+	server := httptest.NewServer(noecho)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	conn.SetPingHandler(func(string) error {
+		return nil
+	})
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, _, err = conn.ReadMessage()
+
+	if err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+func TestBroadcastFilter(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastFilter(msg, func(q *Session) bool {
+			return session == q
+		})
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	fn := func(msg string) bool {
+		conn, err := NewDialer(server.URL)
+		defer conn.Close()
+
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if msg != string(ret) {
+			t.Errorf("%s should equal %s", msg, string(ret))
+			return false
+		}
+
+		return true
+	}
+
+	if !fn("test") {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestBroadcastRoom(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleConnect(func(session *Session) {
+		room := session.MustGet("Room").([]string)[0]
+		broadcast.h.Join(session, room)
+	})
+	broadcast.m.HandleDisconnect(broadcast.h.Unregister)
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastRoom("a", msg)
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	dial := func(room string) *websocket.Conn {
+		dialer := &websocket.Dialer{}
+		header := http.Header{"Room": []string{room}}
+		conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	n := 10
+	listeners := make([]*websocket.Conn, n)
+	for i := 0; i < n; i++ {
+		listeners[i] = dial("a")
+		defer listeners[i].Close()
+	}
+	other := dial("b")
+	defer other.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if online := broadcast.h.RoomOnline("a"); online != n {
+		t.Errorf("room a online %d should equal %d", online, n)
+	}
+
+	other.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	for i := 0; i < n; i++ {
+		_, ret, err := listeners[i].ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(ret) != "test" {
+			t.Errorf("%s should equal test", string(ret))
+		}
+	}
+
+	other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := other.ReadMessage(); err == nil {
+		t.Error("session outside the room should not receive the message")
+	}
+
+	listeners[0].Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if online := broadcast.h.RoomOnline("a"); online != n-1 {
+		t.Errorf("room a online %d should equal %d after unregister", online, n-1)
+	}
+}
+
+func TestJoinLeave(t *testing.T) {
+	h := NewHub()
+
+	s := newTestSession(New())
+	h.Join(s, "a")
+	h.Join(s, "b")
+
+	time.Sleep(10 * time.Millisecond)
+
+	if online := h.Online(); online != 1 {
+		t.Errorf("hub online %d should equal 1", online)
+	}
+
+	if rooms := h.Rooms(s); len(rooms) != 2 {
+		t.Errorf("session should have joined 2 rooms, got %v", rooms)
+	}
+
+	h.Leave(s, "a")
+	h.Unregister(s)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if online := h.RoomOnline("b"); online != 0 {
+		t.Errorf("room b online %d should equal 0 after unregister", online)
+	}
+
+	if rooms := h.Rooms(s); len(rooms) != 0 {
+		t.Errorf("session should have left all rooms, got %v", rooms)
+	}
+}
+
+func TestHubShards(t *testing.T) {
+	m := New()
+	h := NewHub(WithHubSession(1 << 12))
+	if len(h.shards) != 64 {
+		t.Fatalf("hub should have 64 shards, got %d", len(h.shards))
+	}
+
+	n := 1000
+	sessions := make([]*Session, n)
+	wg := &sync.WaitGroup{}
+	for i := range sessions {
+		sessions[i] = newTestSession(m)
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			h.Register(s)
+			h.Join(s, "a")
+		}(sessions[i])
+	}
+	wg.Wait()
+
+	if online := h.Online(); online != n {
+		t.Errorf("hub online %d should equal %d", online, n)
+	}
+	if online := h.RoomOnline("a"); online != n {
+		t.Errorf("room a online %d should equal %d", online, n)
+	}
+
+	visited := map[*Session]int{}
+	h.Range(func(s *Session) {
+		visited[s]++
+	})
+	if len(visited) != n {
+		t.Errorf("range should visit %d sessions, got %d", n, len(visited))
+	}
+
+	for _, s := range sessions {
+		h.Unregister(s)
+	}
+	if online := h.Online(); online != 0 {
+		t.Errorf("hub online %d should equal 0", online)
+	}
+	if online := h.RoomOnline("a"); online != 0 {
+		t.Errorf("room a online %d should equal 0", online)
+	}
+}
+
+func TestHubRegisterDuringBroadcast(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.Config.SlowConsumer = SlowConsumerBlock
+	m.Config.SlowConsumerWait = time.Second
+	m.HandleError(func(*Session, error) {})
+
+	h := NewHub(WithHubSession(1))
+	slow := newTestSession(m)
+	h.Register(slow)
+	slow.Write([]byte("a"))
+	slow.Write([]byte("b"))
+
+	h.Broadcast([]byte("c"))
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	h.Register(newTestSession(m))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("register should not wait for a blocked broadcast, took %v", elapsed)
+	}
+	if online := h.Online(); online != 2 {
+		t.Errorf("hub online %d should equal 2", online)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	m := New()
+	ids := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newTestSession(m).ID()
+		if id == "" || ids[id] {
+			t.Fatalf("session ID %q should be unique", id)
+		}
+		ids[id] = true
+	}
+
+	m.Config.SessionID = func(handshake *Handshake) string {
+		return "fixed"
+	}
+	if id := newTestSession(m).ID(); id != "fixed" {
+		t.Errorf("session ID %q should come from Conf.SessionID", id)
+	}
+}
+
+func TestHubUsers(t *testing.T) {
+	m := New()
+	h := NewHub()
+
+	tab, phone, other := newTestSession(m), newTestSession(m), newTestSession(m)
+	h.Bind(tab, "42")
+	h.Bind(phone, "42")
+	h.Register(other)
+
+	if online := h.Online(); online != 3 {
+		t.Errorf("hub online %d should equal 3", online)
+	}
+	if s, ok := h.Session(other.ID()); !ok || s != other {
+		t.Errorf("session %s should be found by ID", other.ID())
+	}
+	if sessions := h.SessionsByUser("42"); len(sessions) != 2 {
+		t.Errorf("user 42 should have 2 sessions, got %d", len(sessions))
+	}
+	if tab.User() != "42" || other.User() != "" {
+		t.Errorf("sessions should be bound to their users, got %q and %q", tab.User(), other.User())
+	}
+
+	if err := h.SendToUser("42", []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Session{tab, phone} {
+		if msgs := queued(s); len(msgs) != 1 || msgs[0] != "test" {
+			t.Errorf("user session should have the message, got %v", msgs)
+		}
+	}
+	if msgs := queued(other); len(msgs) != 0 {
+		t.Errorf("other session should not have the message, got %v", msgs)
+	}
+
+	h.Bind(phone, "43")
+	if sessions := h.SessionsByUser("43"); len(sessions) != 1 || sessions[0] != phone {
+		t.Errorf("rebound session should move to user 43, got %v", sessions)
+	}
+
+	h.Unregister(tab)
+	if sessions := h.SessionsByUser("42"); len(sessions) != 0 {
+		t.Errorf("user 42 should have no sessions after unregister, got %d", len(sessions))
+	}
+	if _, ok := h.Session(tab.ID()); ok {
+		t.Error("unregistered session should not be found by ID")
+	}
+}
+
+func TestHubCloseSlowSessions(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.Config.SlowConsumer = SlowConsumerBlock
+	m.Config.SlowConsumerWait = 300 * time.Millisecond
+	h := NewHub()
+
+	sessions := make([]*Session, 3)
+	for i := range sessions {
+		sessions[i] = newTestSession(m)
+		h.Register(sessions[i])
+		sessions[i].Write([]byte("a"))
+		sessions[i].Write([]byte("b"))
+	}
+
+	start := time.Now()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > m.Config.SlowConsumerWait/2 {
+		t.Errorf("closing the hub took %v, it should not wait for slow sessions", elapsed)
+	}
+
+	for _, s := range sessions {
+		done := make(chan struct{})
+		go func() {
+			s.writePump()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			s.close()
+			<-done
+		}
+
+		frames := s.conn.(*nopConn).written()
+		if len(frames) != 1 || frames[0].t != CloseMessage {
+			t.Errorf("slow session should only be sent the close frame, got %v", frames)
+		}
+		if cause := context.Cause(s.Context()); cause != nil && cause != ErrHubClosed {
+			t.Errorf("cause %v should be %v", cause, ErrHubClosed)
+		}
+	}
+}
+
+func TestHubClosedSession(t *testing.T) {
+	m := New()
+	h := NewHub()
+
+	s := newTestSession(m)
+	h.Join(s, "a")
+	h.Bind(s, "42")
+	s.close()
+	h.Unregister(s)
+
+	h.Register(s)
+	h.Join(s, "a")
+	h.Bind(s, "42")
+
+	if online := h.Online(); online != 0 {
+		t.Errorf("hub online %d should equal 0", online)
+	}
+	if online := h.RoomOnline("a"); online != 0 {
+		t.Errorf("room online %d should equal 0", online)
+	}
+	if _, ok := h.Session(s.ID()); ok {
+		t.Error("closed session should not be found by ID")
+	}
+	if sessions := h.SessionsByUser("42"); len(sessions) != 0 {
+		t.Errorf("closed session should not be bound, got %v", sessions)
+	}
+}
+
+func TestHubBindConcurrent(t *testing.T) {
+	h := NewHub()
+	s := newTestSession(New())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			h.Bind(s, user)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	for i := 0; i < 16; i++ {
+		user := strconv.Itoa(i)
+		sessions := h.SessionsByUser(user)
+		if bound := user == h.User(s); bound != (len(sessions) == 1) {
+			t.Errorf("user %s should have a session only if it is bound to %s, got %d", user, h.User(s), len(sessions))
+		}
+	}
+}
+
+func TestHubBindMultiple(t *testing.T) {
+	chat, presence := NewHub(), NewHub()
+	s := newTestSession(New())
+
+	chat.Bind(s, "alice")
+	presence.Bind(s, "alice")
+	chat.Bind(s, "bob")
+
+	if user := presence.User(s); user != "alice" {
+		t.Errorf("presence binding %q should stay alice", user)
+	}
+	if sessions := presence.SessionsByUser("alice"); len(sessions) != 1 {
+		t.Errorf("presence should still find alice, got %v", sessions)
+	}
+	if sessions := chat.SessionsByUser("alice"); len(sessions) != 0 {
+		t.Errorf("chat should no longer find alice, got %v", sessions)
+	}
+	if sessions := chat.SessionsByUser("bob"); len(sessions) != 1 {
+		t.Errorf("chat should find bob, got %v", sessions)
+	}
+
+	presence.Unregister(s)
+	if sessions := presence.SessionsByUser("alice"); len(sessions) != 0 {
+		t.Errorf("unregistered session should not be found, got %v", sessions)
+	}
+	chat.Unregister(s)
+	if sessions := chat.SessionsByUser("bob"); len(sessions) != 0 {
+		t.Errorf("unregistered session should not be found, got %v", sessions)
+	}
+}
+
+func TestBroadcastWithReport(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.HandleError(func(*Session, error) {})
+	h := NewHub()
+
+	delivered, full, closed, excluded := newTestSession(m), newTestSession(m), newTestSession(m), newTestSession(m)
+	for _, s := range []*Session{delivered, full, closed, excluded} {
+		h.Register(s)
+	}
+	full.Write([]byte("a"))
+	full.Write([]byte("b"))
+	closed.close()
+
+	report, err := h.BroadcastWithReport(context.Background(), []byte("test"), func(s *Session) bool {
+		return s != excluded
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Matched != 3 || report.Queued != 1 || report.Dropped != 1 || report.Closed != 1 {
+		t.Errorf("report %+v should have 3 matched, 1 queued, 1 dropped and 1 closed", report)
+	}
+	if len(report.DroppedSessions) != 1 || report.DroppedSessions[0] != full {
+		t.Errorf("dropped sessions %v should contain the full session", report.DroppedSessions)
+	}
+	if len(report.ClosedSessions) != 1 || report.ClosedSessions[0] != closed {
+		t.Errorf("closed sessions %v should contain the closed session", report.ClosedSessions)
+	}
+	if msgs := queued(delivered); len(msgs) != 1 || msgs[0] != "test" {
+		t.Errorf("queued session should have the message, got %v", msgs)
+	}
+}
+
+func TestBroadcastWithReportContext(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.Config.SlowConsumer = SlowConsumerBlock
+	m.Config.SlowConsumerWait = 200 * time.Millisecond
+	m.HandleError(func(*Session, error) {})
+	h := NewHub()
+
+	slow := newTestSession(m)
+	h.Register(slow)
+	slow.Write([]byte("a"))
+	slow.Write([]byte("b"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report, err := h.BroadcastWithReport(ctx, []byte("test"), nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("error %v should equal %v", err, context.DeadlineExceeded)
+	}
+	if report.Queued != 0 {
+		t.Errorf("partial report %+v should not have queued the message", report)
+	}
+
+	h.Close()
+	if _, err := h.BroadcastWithReport(context.Background(), []byte("test"), nil); err == nil {
+		t.Error("broadcast to a closed hub should fail")
+	}
+}
+
+func TestBroadcastBinaryFilter(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		broadcast.h.BroadcastBinaryFilter(msg, func(q *Session) bool {
+			return session == q
+		})
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	fn := func(msg []byte) bool {
+		conn, err := NewDialer(server.URL)
+		defer conn.Close()
+
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
+
+		messageType, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if messageType != websocket.BinaryMessage {
+			t.Errorf("message type should be BinaryMessage")
+			return false
+		}
+
+		if !bytes.Equal(msg, ret) {
+			t.Errorf("%v should equal %v", msg, ret)
+			return false
+		}
+
+		return true
+	}
+
+	if !fn([]byte{2, 3, 5, 7, 11}) {
+		t.Errorf("should not be false")
+	}
+}
+
+func TestStop(t *testing.T) {
+	noecho := NewTestServer()
+	server := httptest.NewServer(noecho)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	noecho.h.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	n := 5
+	closed := make(chan error, n)
+	for i := 0; i < n; i++ {
+		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					closed <- err
+					return
+				}
+			}
+		}()
+	}
+
+	if echo.m.Len() != n || len(echo.m.Sessions()) != n {
+		t.Errorf("comet len %d should equal %d", echo.m.Len(), n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := echo.m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		err := <-closed
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("client should read a going away close frame, got %v", err)
+		}
+	}
+
+	if echo.m.Len() != 0 {
+		t.Errorf("comet len %d should equal 0 after shutdown", echo.m.Len())
+	}
+
+	if _, err := NewDialer(server.URL); err == nil {
+		t.Error("new sessions should be rejected after shutdown")
+	}
+
+	if err := echo.m.Handle(newNopConn(), nil); err != ErrServerClosed {
+		t.Errorf("handle should return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestSmallMessageBuffer(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.m.Config.MessageBufferSize = 0
+	echo.m.HandleError(func(s *Session, err error) {
+		if err == nil {
+			t.Error("there should be a buffer full error here")
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("12345"))
+}
+
+func TestPong(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.m.Config.PongWait = time.Second
+	echo.m.Config.PingPeriod = time.Second * 9 / 10
+	fired := make(chan struct{}, 1)
+	echo.m.HandlePong(func(s *Session) {
+		fired <- struct{}{}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.PongMessage, nil)
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Error("should have fired pong handler")
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	tests := []struct {
+		policy SlowConsumerPolicy
+		writes []string
+		queued []string
+		errors int
+		err    error // returned by the last write
+	}{
+		{SlowConsumerDropNewest, []string{"a1", "b1", "a2"}, []string{"a1", "b1"}, 1, ErrBufferFull},
+		{SlowConsumerDropOldest, []string{"a1", "b1", "a2"}, []string{"b1", "a2"}, 1, nil},
+		{SlowConsumerBlock, []string{"a1", "b1", "a2"}, []string{"a1", "b1"}, 1, ErrBufferFull},
+		{SlowConsumerCoalesce, []string{"a1", "b1", "a2", "c1"}, []string{"a2", "b1"}, 1, ErrBufferFull},
+	}
+
+	for _, test := range tests {
+		m := New()
+		m.Config.MessageBufferSize = 2
+		m.Config.SlowConsumer = test.policy
+		m.Config.SlowConsumerWait = 10 * time.Millisecond
+		m.Config.CoalesceKey = func(msg []byte) string {
+			return string(msg[:1])
+		}
+
+		errs := 0
+		m.HandleError(func(s *Session, err error) {
+			if err == ErrBufferFull {
+				errs++
+			}
+		})
+
+		s := newTestSession(m)
+		var err error
+		for _, msg := range test.writes {
+			err = s.Write([]byte(msg))
+		}
+
+		if err != test.err {
+			t.Errorf("policy %d write error %v should equal %v", test.policy, err, test.err)
+		}
+
+		if got := strings.Join(queued(s), ","); got != strings.Join(test.queued, ",") {
+			t.Errorf("policy %d queued %s should equal %v", test.policy, got, test.queued)
+		}
+
+		if errs != test.errors {
+			t.Errorf("policy %d reported %d errors should equal %d", test.policy, errs, test.errors)
+		}
+	}
+}
+
+func TestSlowConsumerDropOldestClose(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.Config.SlowConsumer = SlowConsumerDropOldest
+
+	s := newTestSession(m)
+	s.Write([]byte("a"))
+	s.CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "bye"))
+	s.Write([]byte("b"))
+	if err := s.Write([]byte("c")); err != ErrSessionClosed {
+		t.Errorf("write after a queued close error %v should equal %v", err, ErrSessionClosed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.writePump()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write pump should exit after the close frame")
+	}
+
+	frames := s.conn.(*nopConn).written()
+	if len(frames) != 1 || frames[0].t != CloseMessage {
+		t.Fatalf("the close frame should not be dropped, got %v", frames)
+	}
+}
+
+func TestSlowConsumerClose(t *testing.T) {
+	policies := []SlowConsumerPolicy{SlowConsumerDropNewest, SlowConsumerDropOldest, SlowConsumerBlock, SlowConsumerDisconnect, SlowConsumerCoalesce}
+	for _, policy := range policies {
+		m := New()
+		m.Config.MessageBufferSize = 2
+		m.Config.SlowConsumer = policy
+		m.Config.SlowConsumerWait = time.Second
+		m.Config.CoalesceKey = func(msg []byte) string { return string(msg) }
+
+		s := newTestSession(m)
+		s.Write([]byte("a"))
+		s.Write([]byte("b"))
+
+		start := time.Now()
+		if err := s.CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "bye")); err != nil {
+			t.Errorf("policy %v close error %v should be nil", policy, err)
+		}
+		if elapsed := time.Since(start); elapsed > m.Config.SlowConsumerWait/2 {
+			t.Errorf("policy %v close took %v, it should not wait for room in the buffer", policy, elapsed)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			s.writePump()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			s.close()
+			t.Errorf("policy %v write pump should exit after the close frame", policy)
+			<-done
+			continue
+		}
+
+		frames := s.conn.(*nopConn).written()
+		if len(frames) == 0 || frames[len(frames)-1].t != CloseMessage {
+			t.Errorf("policy %v should send the close frame of a full buffer, got %v", policy, frames)
+		}
+	}
+}
+
+func TestWriteClosedSession(t *testing.T) {
+	s := newTestSession(New())
+	s.close()
+
+	writes := []func([]byte) error{s.Write, s.WriteBinary, s.WriteCompressed, s.WriteBinaryCompressed}
+	for _, write := range writes {
+		if err := write([]byte("a")); !errors.Is(err, ErrSessionClosed) {
+			t.Errorf("write error %v should be %v", err, ErrSessionClosed)
+		}
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	m := New()
+	m.Config.MessageBufferSize = 2
+	m.Config.SlowConsumer = SlowConsumerDisconnect
+
+	s := newTestSession(m)
+	s.Write([]byte("a"))
+	s.Write([]byte("b"))
+	s.Write([]byte("c"))
+
+	done := make(chan struct{})
+	go func() {
+		s.writePump()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write pump should exit after a disconnect")
+	}
+
+	conn := s.conn.(*nopConn)
+	frames := conn.written()
+	if len(frames) != 1 || frames[0].t != CloseMessage {
+		t.Fatalf("only a close frame should be written, got %v", frames)
+	}
+
+	expected := FormatCloseMessage(ClosePolicyViolation, ErrBufferFull.Error())
+	if !bytes.Equal(frames[0].msg, expected) {
+		t.Errorf("close frame %v should equal %v", frames[0].msg, expected)
+	}
+
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("connection should be closed")
+	}
+}
+
+// NewTCPTestServer serves m on a local tcp listener and returns its address.
+func NewTCPTestServer(t *testing.T, m *Comet) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.Handle(NewTConn(conn), map[string]interface{}{})
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestTCPEcho(t *testing.T) {
+	m := New()
+	m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	m.HandleMessageBinary(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, messageType := range []int{TextMessage, BinaryMessage} {
+		fn := func(msg []byte) bool {
+			if err := conn.WriteMessage(messageType, msg); err != nil {
+				t.Error(err)
+				return false
+			}
+
+			ret, data, err := conn.ReadMessage()
+
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			if ret != messageType {
+				t.Errorf("message type %d should equal %d", ret, messageType)
+				return false
+			}
+
+			if !bytes.Equal(msg, data) {
+				t.Errorf("%v should equal %v", msg, data)
+				return false
+			}
+
+			return true
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTCPPingPong(t *testing.T) {
+	m := New()
+	m.Config.PingPeriod = 10 * time.Millisecond
+	m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+
+	pongs := make(chan struct{}, 1)
+	m.HandlePong(func(s *Session) {
+		select {
+		case pongs <- struct{}{}:
+		default:
+		}
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pinged := make(chan string, 1)
+	conn.SetPongHandler(func(msg string) error {
+		pinged <- msg
+		return nil
+	})
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := conn.WriteMessage(PingMessage, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-pinged:
+		if msg != "ping" {
+			t.Errorf("pong payload %s should equal ping", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("server should answer a ping with a pong")
+	}
+
+	select {
+	case <-pongs:
+	case <-time.After(time.Second):
+		t.Error("client should answer server pings with pongs")
+	}
+}
+
+func TestTCPPingDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newTConn(server)
+	defer conn.Close()
+
+	pongs := make(chan string, 1)
+	reader := newTConn(client)
+	reader.SetPongHandler(func(msg string) error {
+		pongs <- msg
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := reader.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := conn.handlePing("ping"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-pongs:
+		if msg != "ping" {
+			t.Errorf("pong payload %s should equal ping", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping should be answered with a pong")
+	}
+
+	err := conn.WriteMessage(TextMessage, []byte("late"))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("write error %v should be a timeout, the pong should restore the write deadline", err)
+	}
+}
+
+func TestTCPClose(t *testing.T) {
+	m := New()
+
+	disconnected := make(chan error, 1)
+	m.HandleError(func(s *Session, err error) {
+		select {
+		case disconnected <- err:
+		default:
+		}
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(CloseMessage, FormatCloseMessage(CloseNormalClosure, "bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = conn.ReadMessage()
+	if e, ok := err.(*CloseError); !ok || e.Code != CloseNormalClosure {
+		t.Errorf("server should echo the close frame, got %v", err)
+	}
+
+	select {
+	case err := <-disconnected:
+		if e, ok := err.(*CloseError); !ok || e.Code != CloseNormalClosure || e.Text != "bye" {
+			t.Errorf("session should read the close frame, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("session should be closed")
+	}
+}
+
+func TestTCPSessionClose(t *testing.T) {
+	m := New()
+	m.HandleConnect(func(s *Session) {
+		s.CloseWithMsg(FormatCloseMessage(ClosePolicyViolation, "go away"))
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	if e, ok := err.(*CloseError); !ok || e.Code != ClosePolicyViolation || e.Text != "go away" {
+		t.Errorf("client should read the close frame, got %v", err)
+	}
+}
+
+func TestTCPServerShutdown(t *testing.T) {
+	m := New()
+	m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+
+	srv, err := ListenTCP(m, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(context.Background())
+	}()
+
+	n := 5
+	closed := make(chan error, n)
+	for i := 0; i < n; i++ {
+		conn, err := DialTCP(srv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(TextMessage, []byte("test"))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					closed <- err
+					return
+				}
+			}
+		}()
+	}
+
+	if srv.Len() != n {
+		t.Errorf("server len %d should equal %d", srv.Len(), n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		err := <-closed
+		if e, ok := err.(*CloseError); !ok || e.Code != CloseGoingAway {
+			t.Errorf("client should read a going away close frame, got %v", err)
+		}
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("serve should return ErrServerClosed, got %v", err)
+	}
+
+	if _, err := DialTCP(srv.Addr().String()); err == nil {
+		t.Error("server should stop accepting connections")
+	}
+}
+
+func TestTCPServerShutdownDeadline(t *testing.T) {
+	m := New()
+
+	connected := make(chan *Session, 1)
+	m.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+
+	srv, err := ListenTCP(m, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+
+	// the client never reads, so it never answers the close frame.
+	conn, err := DialTCP(srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session := <-connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = srv.Shutdown(ctx)
+	e, ok := err.(*ShutdownError)
+	if !ok {
+		t.Fatalf("shutdown should report unfinished sessions, got %v", err)
+	}
+
+	if len(e.Sessions) != 1 || e.Sessions[0] != session {
+		t.Errorf("shutdown should report the unfinished session, got %v", e.Sessions)
+	}
+
+	if !session.IsClosed() {
+		t.Error("unfinished session should be closed")
+	}
+}
+
+func TestTCPCompression(t *testing.T) {
+	m := New()
+	m.Config.MaxMessageSize = 1 << 16
+	m.Config.CompressThreshold = 128
+	m.HandleMessage(func(session *Session, msg []byte) {
+		if string(msg) == "force" {
+			session.WriteCompressed(msg)
+			return
+		}
+		session.Write(msg)
+	})
+
+	srv, err := ListenTCP(m, "127.0.0.1:0", WithTCPCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Shutdown(context.Background())
+
+	raw, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	conn := newTConn(raw)
+
+	large := strings.Repeat("test", 1024)
+	tests := []struct {
+		msg        string
+		compress   bool
+		compressed bool
+	}{
+		{"small", false, false},
+		{large, false, true},
+		{large, true, true},
+		{"force", false, true},
+	}
+
+	for _, test := range tests {
+		conn.EnableWriteCompression(test.compress)
+		if err := conn.WriteMessage(TextMessage, []byte(test.msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		header := make([]byte, tcpHeaderSize)
+		if _, err := io.ReadFull(raw, header); err != nil {
+			t.Fatal(err)
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		frameType := binary.BigEndian.Uint32(header[4:8])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(raw, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if compressed := frameType&tcpCompressed != 0; compressed != test.compressed {
+			t.Errorf("message of %d bytes compressed %v should equal %v", len(test.msg), compressed, test.compressed)
+			continue
+		}
+
+		if test.compressed {
+			inflated, err := conn.inflate(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(payload) >= len(test.msg) && len(test.msg) > 128 {
+				t.Errorf("compressed payload %d should be smaller than %d", len(payload), len(test.msg))
+			}
+			payload = inflated
+		}
+
+		if string(payload) != test.msg {
+			t.Errorf("echo should round trip, got %d bytes", len(payload))
+		}
+	}
+}
+
+func TestTCPPreparedMessage(t *testing.T) {
+	pm := NewPreparedMessage(TextMessage, []byte(strings.Repeat("test", 1024)))
+	frames := make([][]byte, 0)
+	for _, compress := range []bool{false, true, true} {
+		client, server := net.Pipe()
+		conn := newTConn(server)
+		conn.EnableWriteCompression(compress)
+		go func() {
+			conn.WritePreparedMessage(pm)
+			server.Close()
+		}()
+		frame, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+
+		client, server = net.Pipe()
+		go func() {
+			server.Write(frame)
+			server.Close()
+		}()
+		_, msg, err := newTConn(client).ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, pm.msg) {
+			t.Errorf("prepared message should round trip, compressed %v", compress)
+		}
+	}
+
+	if len(pm.tcp) != 2 {
+		t.Errorf("frames should be encoded once per compression setting, got %d", len(pm.tcp))
+	}
+	if !bytes.Equal(frames[1], frames[2]) {
+		t.Error("connections with the same compression setting should write the same frame")
+	}
+	if bytes.Equal(frames[0], frames[1]) {
+		t.Error("compressed frame should differ from the uncompressed one")
+	}
+}
+
+func TestTCPBroadcast(t *testing.T) {
+	m := New()
+	h := NewHub()
+	m.HandleConnect(h.Register)
+	m.HandleDisconnect(h.Unregister)
+	addr := NewTCPTestServer(t, m)
+
+	conns := make([]Conn, 0)
+	for i := 0; i < 10; i++ {
+		conn, err := DialTCP(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for h.Online() < len(conns) {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.BroadcastBinary([]byte("test"))
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_type, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _type != BinaryMessage || string(msg) != "test" {
+			t.Errorf("broadcast should be received, got %d %q", _type, msg)
+		}
+	}
+}
+
+func TestTCPInflateLimit(t *testing.T) {
+	m := New()
+	m.Config.MaxMessageSize = 1024
+	errs := make(chan error, 1)
+	m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	addr := NewTCPTestServer(t, m)
+
+	conn, err := DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a small compressed frame must not inflate beyond the read limit.
+	conn.(Compressor).EnableWriteCompression(true)
+	conn.WriteMessage(TextMessage, make([]byte, 1<<20))
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "beyond the max") {
+			t.Errorf("inflated size should be limited, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("oversized compressed frame should be rejected")
+	}
+}
+
+func TestTCPUnix(t *testing.T) {
+	m := New()
+	sessions := make(chan *Session, 1)
+	m.HandleConnect(func(s *Session) {
+		sessions <- s
+	})
+	m.HandleMessage(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+
+	path := filepath.Join(t.TempDir(), "comet.sock")
+	srv, err := Listen(m, "unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Shutdown(context.Background())
+
+	conn, err := Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(TextMessage, []byte("test"))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "test" {
+		t.Errorf("echo should equal test, got %s %v", msg, err)
+	}
+
+	credentials := (<-sessions).Handshake().Credentials
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if credentials == nil {
+		t.Fatal("unix sessions should have the peer credentials")
+	}
+	if int(credentials.PID) != os.Getpid() || int(credentials.UID) != os.Getuid() || int(credentials.GID) != os.Getgid() {
+		t.Errorf("peer credentials %+v should be the ones of the test process", credentials)
+	}
+}
+
+// newTestTLS returns the config of a server requiring client certificates and
+// of a client presenting the certificate of commonName, if any.
+func newTestTLS(t *testing.T, commonName string) (*tls.Config, *tls.Config) {
+	issue := func(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+	}
+
+	template := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+	}
+
+	caTemplate := template(1, "ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caCert := issue(caTemplate, nil, nil)
+	caKey := ca.PrivateKey.(*ecdsa.PrivateKey)
+
+	serverTemplate := template(2, "server")
+	serverTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	server, _ := issue(serverTemplate, caCert, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	clientConfig := &tls.Config{RootCAs: pool}
+	if commonName != "" {
+		client, _ := issue(template(3, commonName), caCert, caKey)
+		clientConfig.Certificates = []tls.Certificate{client}
+	}
+	return serverConfig, clientConfig
+}
+
+func TestTCPTLS(t *testing.T) {
+	m := New()
+	sessions := make(chan *Session, 1)
+	m.HandleConnect(func(s *Session) {
+		sessions <- s
+	})
+
+	serverConfig, clientConfig := newTestTLS(t, "client")
+	srv, err := ListenTLS(m, "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Shutdown(context.Background())
+
+	conn, err := DialTLS(srv.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case s := <-sessions:
+		state := s.Handshake().TLS
+		if state == nil || len(state.PeerCertificates) == 0 {
+			t.Fatal("tls sessions should have the peer certificates")
+		}
+		if name := state.PeerCertificates[0].Subject.CommonName; name != "client" {
+			t.Errorf("peer certificate %s should be the client one", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tls session should connect")
+	}
+
+	// connections without a client certificate are rejected during the TLS handshake
+	_, anonymous := newTestTLS(t, "")
+	anonymous.RootCAs = clientConfig.RootCAs
+	if conn, err := DialTLS(srv.Addr().String(), anonymous); err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Error("connection without a client certificate should fail")
+		}
+		conn.Close()
+	}
+	select {
+	case <-sessions:
+		t.Error("connection without a client certificate should not connect a session")
+	default:
+	}
+}
+
+func TestTCPTLSAuthenticate(t *testing.T) {
+	m := New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "admin" {
+			return nil, ErrForbidden
+		}
+		return map[string]interface{}{"user": "admin"}, nil
+	})
+	users := make(chan string, 1)
+	m.HandleConnect(func(s *Session) {
+		users <- s.GetString("user")
+	})
+
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"admin", http.StatusSwitchingProtocols},
+		{"guest", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		serverConfig, clientConfig := newTestTLS(t, test.name)
+		srv, err := ListenTLS(m, "127.0.0.1:0", serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(context.Background())
+
+		tlsConn, err := tls.Dial("tcp", srv.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, res, err := ClientHandshake(tlsConn, srv.Addr().String(), "/", nil)
+		if res == nil || res.StatusCode != test.status {
+			t.Errorf("%s: handshake should answer %d, got %v %v", test.name, test.status, res, err)
+		}
+		if err == nil {
+			if user := <-users; user != "admin" {
+				t.Errorf("%s: session user %q should equal admin", test.name, user)
+			}
+			conn.Close()
+		}
+		srv.Shutdown(context.Background())
+	}
+}
+
+// sseClient reads the events of a Server-Sent Events stream.
+func TestServeHTTP(t *testing.T) {
+	m := New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		return map[string]interface{}{"user": "authenticated"}, nil
+	})
+	sessions := make(chan *Session, 1)
+	m.HandleConnect(func(s *Session) {
+		sessions <- s
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = WithRequestKeys(r, map[string]interface{}{"room": "lobby", "user": "param"})
+		r = WithRequestKeys(r, map[string]interface{}{"room": "gophers"})
+		m.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := <-sessions
+	if room := s.GetString("room"); room != "gophers" {
+		t.Errorf("request key room %q should equal gophers", room)
+	}
+	if user := s.GetString("user"); user != "authenticated" {
+		t.Errorf("authenticated key user %q should override the request key", user)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(New().Handler(WithGwsOrigins("https://example.com")))
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("upgrade from another origin should be forbidden, got %v", err)
+	}
+}
+
+type sseClient struct {
+	url    string
+	token  string
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+// sseEvent is an event, or a comment if name is ":".
+type sseEvent struct {
+	name string
+	data string
+}
+
+func NewSseClient(t *testing.T, url string) *sseClient {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("event stream should be opened, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	c := &sseClient{url: url, body: res.Body, reader: bufio.NewReader(res.Body)}
+	t.Cleanup(func() { c.body.Close() })
+
+	open, err := c.next()
+	if err != nil || open.name != "open" {
+		t.Fatalf("first event %v should be open, got error %v", open, err)
+	}
+	c.token = open.data
+	return c
+}
+
+func (c *sseClient) next() (sseEvent, error) {
+	var event sseEvent
+	var data []string
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return event, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event.name == "" && data == nil {
+				continue
+			}
+			event.data = strings.Join(data, "\n")
+			return event, nil
+		case strings.HasPrefix(line, ":"):
+			event.name = ":"
+			data = []string{}
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func (c *sseClient) post(contentType string, msg string) (int, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return 0, err
+	}
+	query := u.Query()
+	query.Set("session", c.token)
+	u.RawQuery = query.Encode()
+	res, err := http.Post(u.String(), contentType, strings.NewReader(msg))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// NewHTTPTestServer serves handler, its requests share the streams of handler
+// so the polls and posts of a session reach it.
+func NewHTTPTestServer(t *testing.T, handler HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSse(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if string(msg) == "close" {
+			session.CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "bye"))
+			return
+		}
+		session.Write(msg)
+	})
+	echo.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	server := NewHTTPTestServer(t, HandleSse(echo.m))
+
+	c := NewSseClient(t, server.URL)
+	for echo.h.Online() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		contentType string
+		msg         string
+		want        sseEvent
+	}{
+		{"text/plain", "test", sseEvent{"", "test"}},
+		{"text/plain", "a\nb", sseEvent{"", "a\nb"}},
+		{"application/octet-stream", "test", sseEvent{"binary", "dGVzdA=="}},
+		{"text/plain", "close", sseEvent{"close", "1000 bye"}},
+	}
+	for _, test := range tests {
+		status, err := c.post(test.contentType, test.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusNoContent {
+			t.Errorf("post should be accepted, got %d", status)
+		}
+		event, err := c.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event != test.want {
+			t.Errorf("event %v should equal %v", event, test.want)
+		}
+	}
+
+	if _, err := c.next(); err != io.EOF {
+		t.Errorf("stream should end after the close event, got %v", err)
+	}
+	if status, _ := c.post("text/plain", "test"); status != http.StatusNotFound {
+		t.Errorf("post to a closed stream should not be found, got %d", status)
+	}
+}
+
+func TestSseBroadcast(t *testing.T) {
+	srv := NewTestServer()
+	disconnected := make(chan *Session, 1)
+	srv.m.HookDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+	server := NewHTTPTestServer(t, HandleSse(srv.m))
+
+	clients := []*sseClient{NewSseClient(t, server.URL), NewSseClient(t, server.URL)}
+	for srv.h.Online() != len(clients) {
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.h.Broadcast([]byte("test"))
+	for _, c := range clients {
+		if event, err := c.next(); err != nil || event.data != "test" {
+			t.Errorf("broadcast should be received, got %v %v", event, err)
+		}
+	}
+
+	clients[0].body.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Error("session should disconnect when its stream is closed")
+	}
+	if online := srv.h.Online(); online != 1 {
+		t.Errorf("hub online %d should equal 1", online)
+	}
+}
+
+func TestSsePing(t *testing.T) {
+	srv := NewTestServer()
+	srv.m.Config.PingPeriod = 10 * time.Millisecond
+	srv.m.Config.PongWait = 50 * time.Millisecond
+	server := NewHTTPTestServer(t, HandleSse(srv.m, WithSseRetry(time.Second)))
+
+	c := NewSseClient(t, server.URL)
+	start := time.Now()
+	for time.Since(start) < 150*time.Millisecond {
+		event, err := c.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.name != ":" {
+			t.Errorf("event %v should be a ping comment", event)
+		}
+	}
+	if online := srv.h.Online(); online != 1 {
+		t.Errorf("pinged session should stay online past the pong wait, got %d", online)
+	}
+}
+
+func TestSseReject(t *testing.T) {
+	srv := NewTestServer()
+	srv.m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		if r.URL.Query().Get("token") != "secret" {
+			return nil, ErrUnauthorized
+		}
+		return nil, nil
+	})
+	srv.m.Config.MaxMessageSize = 8
+	server := NewHTTPTestServer(t, HandleSse(srv.m))
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated stream should be rejected, got %d", res.StatusCode)
+	}
+
+	c := NewSseClient(t, server.URL+"?token=secret")
+	if status, _ := c.post("text/plain", strings.Repeat("test", 4)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("post beyond the read limit should be rejected, got %d", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("put should not be allowed, got %d", res.StatusCode)
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes wait until release is closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(data []byte) (int, error) {
+	w.writing <- struct{}{}
+	<-w.release
+	return w.ResponseRecorder.Write(data)
+}
+
+func (w *blockingWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+func TestSseSlowWrite(t *testing.T) {
+	w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	conn := &sConn{httpConn: newHTTPConn(request, 1), writer: w, controller: http.NewResponseController(w)}
+	streams := newHTTPStreams()
+	streams.add(conn)
+
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.WriteMessage(TextMessage, []byte("slow"))
+	}()
+	<-w.writing
+
+	done := make(chan int, 1)
+	go func() {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		post := httptest.NewRequest(http.MethodPost, "/?session="+conn.token, strings.NewReader("test"))
+		status, _ := streams.post(httptest.NewRecorder(), post)
+		done <- status
+	}()
+
+	select {
+	case status := <-done:
+		if status != http.StatusNoContent {
+			t.Errorf("post status %d should equal %d", status, http.StatusNoContent)
+		}
+	case <-time.After(time.Second):
+		t.Error("a slow write should not block posts and read deadlines")
+	}
+
+	close(w.release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type longPollClient struct {
+	url   string
+	token string
+}
+
+func NewLongPollClient(t *testing.T, url string) *longPollClient {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var open struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&open); err != nil || res.StatusCode != http.StatusOK || open.Session == "" {
+		t.Fatalf("session should be opened, got %d %v", res.StatusCode, err)
+	}
+	return &longPollClient{url: url, token: open.Session}
+}
+
+func (c *longPollClient) request(method string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	values := u.Query()
+	values.Set("session", c.token)
+	for key := range query {
+		values.Set(key, query.Get(key))
+	}
+	u.RawQuery = values.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// poll polls the messages of the session, ack is sent unless it is negative.
+func (c *longPollClient) poll(ack int) (int, []polledMessage, error) {
+	query := url.Values{}
+	if ack >= 0 {
+		query.Set("ack", strconv.Itoa(ack))
+	}
+	res, err := c.request(http.MethodGet, query, "", nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil, nil
+	}
+	var messages []polledMessage
+	err = json.NewDecoder(res.Body).Decode(&messages)
+	return res.StatusCode, messages, err
+}
+
+func (c *longPollClient) post(contentType string, msg string) (int, error) {
+	res, err := c.request(http.MethodPost, nil, contentType, strings.NewReader(msg))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestLongPoll(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if string(msg) == "close" {
+			session.CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "bye"))
+			return
+		}
+		session.Write(msg)
+	})
+	echo.m.HandleMessageBinary(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	server := NewHTTPTestServer(t, HandleLongPoll(echo.m))
+
+	c := NewLongPollClient(t, server.URL)
+	for echo.h.Online() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		contentType string
+		msg         string
+		want        polledMessage
+	}{
+		{"text/plain", "test", polledMessage{1, "text", "test"}},
+		{"application/octet-stream", "test", polledMessage{2, "binary", "dGVzdA=="}},
+		{"text/plain", "close", polledMessage{3, "close", "1000 bye"}},
+	}
+	for _, test := range tests {
+		if status, err := c.post(test.contentType, test.msg); err != nil || status != http.StatusNoContent {
+			t.Fatalf("post should be accepted, got %d %v", status, err)
+		}
+		status, messages, err := c.poll(int(test.want.Seq) - 1)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("poll should succeed, got %d %v", status, err)
+		}
+		if len(messages) != 1 || messages[0] != test.want {
+			t.Errorf("polled messages %v should equal [%v]", messages, test.want)
+		}
+	}
+
+	if status, _, _ := c.poll(3); status != http.StatusGone && status != http.StatusNotFound {
+		t.Errorf("poll of a closed session should fail, got %d", status)
+	}
+	for echo.h.Online() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLongPollResume(t *testing.T) {
+	srv := NewTestServer()
+	sessions := make(chan *Session, 1)
+	srv.m.HookConnect(func(s *Session) {
+		sessions <- s
+	})
+	server := NewHTTPTestServer(t, HandleLongPoll(srv.m, WithLongPollWait(100*time.Millisecond)))
+
+	c := NewLongPollClient(t, server.URL)
+	s := <-sessions
+
+	s.Write([]byte("a"))
+	if _, messages, _ := c.poll(0); len(messages) != 1 || messages[0].Data != "a" {
+		t.Fatalf("poll should return a, got %v", messages)
+	}
+
+	// the response was lost, the message is answered again with the next one
+	s.Write([]byte("b"))
+	for len(s.conn.(*pConn).outgoing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, messages, _ := c.poll(0)
+	if want := []polledMessage{{1, "text", "a"}, {2, "text", "b"}}; len(messages) != 2 || messages[0] != want[0] || messages[1] != want[1] {
+		t.Errorf("unacknowledged messages %v should equal %v", messages, want)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Write([]byte("c"))
+	}()
+	_, messages, _ = c.poll(2)
+	if want := (polledMessage{3, "text", "c"}); len(messages) != 1 || messages[0] != want {
+		t.Errorf("held poll %v should return %v", messages, want)
+	}
+
+	// polls without ack acknowledge every message
+	s.Write([]byte("d"))
+	_, messages, _ = c.poll(-1)
+	if want := (polledMessage{4, "text", "d"}); len(messages) != 1 || messages[0] != want {
+		t.Errorf("poll %v should return %v", messages, want)
+	}
+	_, messages, _ = c.poll(-1)
+	if len(messages) != 0 {
+		t.Errorf("acknowledged messages should not be answered again, got %v", messages)
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	srv := NewTestServer()
+	srv.m.Config.PongWait = 50 * time.Millisecond
+	srv.m.Config.PingPeriod = 10 * time.Millisecond
+	disconnected := make(chan *Session, 1)
+	srv.m.HookDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+	server := NewHTTPTestServer(t, HandleLongPoll(srv.m))
+
+	c := NewLongPollClient(t, server.URL)
+	start := time.Now()
+	for time.Since(start) < 150*time.Millisecond {
+		if status, messages, err := c.poll(-1); err != nil || status != http.StatusOK || len(messages) != 0 {
+			t.Fatalf("held poll should answer no messages, got %d %v %v", status, messages, err)
+		}
+	}
+	if online := srv.h.Online(); online != 1 {
+		t.Errorf("polling session should stay online past the pong wait, got %d", online)
+	}
+
+	select {
+	case s := <-disconnected:
+		if cause := context.Cause(s.Context()); !errors.Is(cause, os.ErrDeadlineExceeded) {
+			t.Errorf("idle session should close with a deadline error, got %v", cause)
 		}
+	case <-time.After(time.Second):
+		t.Error("session should disconnect once polls stop")
+	}
+}
 
-		return true
+func TestLongPollLifetime(t *testing.T) {
+	srv := NewTestServer()
+	disconnected := make(chan *Session, 1)
+	srv.m.HookDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+	server := NewHTTPTestServer(t, HandleLongPoll(srv.m, WithLongPollWait(20*time.Millisecond), WithLongPollLifetime(50*time.Millisecond)))
+
+	c := NewLongPollClient(t, server.URL)
+	var messages []polledMessage
+	for len(messages) == 0 {
+		status, polled, err := c.poll(-1)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("poll should be answered, got %d %v", status, err)
+		}
+		messages = polled
+	}
+	if want := fmt.Sprintf("%d %s", CloseGoingAway, ErrSessionExpired); messages[0].Type != "close" || messages[0].Data != want {
+		t.Errorf("expired session should be closed with %q, got %+v", want, messages[0])
 	}
 
-	if !fn([]byte{2, 3, 5, 7, 11}) {
-		t.Errorf("should not be false")
+	select {
+	case s := <-disconnected:
+		if cause := context.Cause(s.Context()); cause != ErrSessionExpired {
+			t.Errorf("expired session cause %v should equal %v", cause, ErrSessionExpired)
+		}
+	case <-time.After(time.Second):
+		t.Error("expired session should disconnect")
 	}
 }
 
-func TestPingPong(t *testing.T) {
-	noecho := NewTestServer()
-	noecho.m.Config.PongWait = time.Second
-	noecho.m.Config.PingPeriod = time.Second * 9 / 10
-	server := httptest.NewServer(noecho)
-	defer server.Close()
-
-	conn, err := NewDialer(server.URL)
-	conn.SetPingHandler(func(string) error {
-		return nil
+func TestLongPollReject(t *testing.T) {
+	srv := NewTestServer()
+	srv.m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		if r.URL.Query().Get("token") != "secret" {
+			return nil, ErrUnauthorized
+		}
+		return nil, nil
 	})
-	defer conn.Close()
+	disconnected := make(chan *Session, 1)
+	srv.m.HookDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+	server := NewHTTPTestServer(t, HandleLongPoll(srv.m))
 
+	res, err := http.Get(server.URL)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated session should be rejected, got %d", res.StatusCode)
 	}
 
-	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+	unknown := &longPollClient{url: server.URL, token: "unknown"}
+	if status, _, _ := unknown.poll(-1); status != http.StatusNotFound {
+		t.Errorf("poll of an unknown session should not be found, got %d", status)
+	}
 
-	_, _, err = conn.ReadMessage()
+	c := NewLongPollClient(t, server.URL+"?token=secret")
+	res, err = c.request(http.MethodPut, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("put should not be allowed, got %d", res.StatusCode)
+	}
 
-	if err == nil {
-		t.Error("there should be an error")
+	res, err = c.request(http.MethodDelete, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("delete should close the session, got %d", res.StatusCode)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Error("deleted session should disconnect")
 	}
 }
 
-func TestBroadcastFilter(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
-		broadcast.h.BroadcastFilter(msg, func(q *Session) bool {
-			return session == q
-		})
+func TestNegotiate(t *testing.T) {
+	srv := NewTestServer()
+	server := NewHTTPTestServer(t, HandleNegotiate(srv.m, WithNegotiateTransports(TransportSse, TransportLongPoll)))
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var negotiated struct {
+		Transports []string `json:"transports"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&negotiated)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{TransportSse, TransportLongPoll}; fmt.Sprint(negotiated.Transports) != fmt.Sprint(want) {
+		t.Errorf("transports %v should equal %v", negotiated.Transports, want)
+	}
+
+	if _, err := NewDialer(server.URL); err == nil {
+		t.Error("websocket should not be offered")
+	}
+	res, err = http.Get(server.URL + "?transport=carrier-pigeon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown transport should be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestNegotiateFallback(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
 	})
-	server := httptest.NewServer(broadcast)
-	defer server.Close()
+	server := NewHTTPTestServer(t, HandleNegotiate(echo.m))
 
-	fn := func(msg string) bool {
+	t.Run(TransportWebsocket, func(t *testing.T) {
 		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
 		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "test" {
+			t.Errorf("websocket echo should equal test, got %s %v", msg, err)
+		}
+	})
 
-		if err != nil {
-			t.Error(err)
-			return false
+	t.Run(TransportSse, func(t *testing.T) {
+		c := NewSseClient(t, server.URL+"?transport=sse")
+		if status, err := c.post("text/plain", "test"); err != nil || status != http.StatusNoContent {
+			t.Fatalf("post should be accepted, got %d %v", status, err)
+		}
+		if event, err := c.next(); err != nil || event.data != "test" {
+			t.Errorf("sse echo should equal test, got %v %v", event, err)
 		}
+	})
 
-		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	t.Run(TransportLongPoll, func(t *testing.T) {
+		c := NewLongPollClient(t, server.URL+"?transport=longpoll")
+		if status, err := c.post("text/plain", "test"); err != nil || status != http.StatusNoContent {
+			t.Fatalf("post should be accepted, got %d %v", status, err)
+		}
+		if _, messages, err := c.poll(0); err != nil || len(messages) != 1 || messages[0].Data != "test" {
+			t.Errorf("long-poll echo should equal test, got %v %v", messages, err)
+		}
+	})
+}
 
-		_, ret, err := conn.ReadMessage()
+func TestNegotiateUpgrade(t *testing.T) {
+	srv := NewTestServer()
+	sessions := make(chan *Session, 1)
+	srv.m.HookConnect(func(s *Session) {
+		sessions <- s
+	})
+	received := make(chan string, 2)
+	srv.m.HandleMessage(func(s *Session, msg []byte) {
+		received <- string(msg)
+	})
+	server := NewHTTPTestServer(t, HandleNegotiate(srv.m, WithNegotiateLongPoll(WithLongPollWait(100*time.Millisecond))))
 
-		if err != nil {
-			t.Error(err)
-			return false
+	c := NewLongPollClient(t, server.URL+"?transport=longpoll")
+	s := <-sessions
+
+	s.Write([]byte("a"))
+	if _, messages, _ := c.poll(0); len(messages) != 1 || messages[0].Data != "a" {
+		t.Fatalf("poll should return a, got %v", messages)
+	}
+	if status, _ := c.post("text/plain", "posted"); status != http.StatusNoContent {
+		t.Fatalf("post should be accepted, got %d", status)
+	}
+
+	// b is polled but the response is lost, c is still queued
+	s.Write([]byte("b"))
+	if _, messages, _ := c.poll(1); len(messages) != 1 || messages[0].Data != "b" {
+		t.Fatalf("poll should return b, got %v", messages)
+	}
+	s.Write([]byte("c"))
+	for len(s.conn.(*pConn).outgoing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	conn, err := NewDialer(server.URL + "?session=" + c.token + "&ack=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s.Write([]byte("d"))
+
+	for _, want := range []string{"b", "c", "d"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != want {
+			t.Fatalf("upgraded message should equal %s, got %s %v", want, msg, err)
 		}
+	}
 
-		if msg != string(ret) {
-			t.Errorf("%s should equal %s", msg, string(ret))
-			return false
+	conn.WriteMessage(websocket.TextMessage, []byte("upgraded"))
+	for _, want := range []string{"posted", "upgraded"} {
+		select {
+		case msg := <-received:
+			if msg != want {
+				t.Errorf("received message %s should equal %s", msg, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s should be received", want)
 		}
+	}
 
-		return true
+	if status, _, _ := c.poll(4); status != http.StatusGone {
+		t.Errorf("poll of an upgraded session should be gone, got %d", status)
+	}
+	select {
+	case <-sessions:
+		t.Error("upgrade should not connect another session")
+	default:
+	}
+	if online := srv.h.Online(); online != 1 {
+		t.Errorf("hub online %d should equal 1", online)
 	}
 
-	if !fn("test") {
-		t.Errorf("should not be false")
+	s.Close()
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("websocket should be closed with the session")
 	}
 }
 
-func TestBroadcastBinaryFilter(t *testing.T) {
-	broadcast := NewTestServer()
-	broadcast.m.HandleMessageBinary(func(session *Session, msg []byte) {
-		broadcast.h.BroadcastBinaryFilter(msg, func(q *Session) bool {
-			return session == q
-		})
-	})
-	server := httptest.NewServer(broadcast)
-	defer server.Close()
+// countingConn counts the bytes read from a net.Conn.
+type countingConn struct {
+	net.Conn
+	read int64
+}
 
-	fn := func(msg []byte) bool {
-		conn, err := NewDialer(server.URL)
-		defer conn.Close()
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
 
-		if err != nil {
-			t.Error(err)
-			return false
-		}
+func TestNegotiateUpgradeCompression(t *testing.T) {
+	srv := NewTestServer()
+	sessions := make(chan *Session, 1)
+	srv.m.HookConnect(func(s *Session) {
+		sessions <- s
+	})
+	srv.m.Config.CompressThreshold = 1 << 20
+	server := NewHTTPTestServer(t, HandleNegotiate(srv.m, WithNegotiateGws(WithGwsCompression(true))))
 
-		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
+	c := NewLongPollClient(t, server.URL+"?transport=longpoll")
+	s := <-sessions
+	if s.Handshake().Compression {
+		t.Error("long-polling session should not report compression before the upgrade")
+	}
 
-		messageType, ret, err := conn.ReadMessage()
+	counted := &countingConn{}
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			counted.Conn = conn
+			return counted, err
+		},
+	}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1)+"?session="+c.token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-		if err != nil {
-			t.Error(err)
-			return false
-		}
+	deadline := time.Now().Add(time.Second)
+	for !s.compression() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.Handshake().Compression {
+		t.Fatal("upgraded session should report the negotiated compression")
+	}
 
-		if messageType != websocket.BinaryMessage {
-			t.Errorf("message type should be BinaryMessage")
-			return false
+	msg := strings.Repeat("test", 4096)
+	writes := []struct {
+		write      func([]byte) error
+		compressed bool
+	}{
+		{s.Write, false},
+		{s.WriteCompressed, true},
+	}
+	for _, w := range writes {
+		before := atomic.LoadInt64(&counted.read)
+		w.write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != msg {
+			t.Fatalf("upgraded message should round trip, got %v", err)
 		}
+		read := atomic.LoadInt64(&counted.read) - before
+		if compressed := read < int64(len(msg)); compressed != w.compressed {
+			t.Errorf("upgraded message should be compressed %v, read %d bytes for a %d bytes message", w.compressed, read, len(msg))
+		}
+	}
+}
 
-		if !bytes.Equal(msg, ret) {
-			t.Errorf("%v should equal %v", msg, ret)
-			return false
+func TestNegotiateUpgradeOrder(t *testing.T) {
+	srv := NewTestServer()
+	sessions := make(chan *Session, 1)
+	srv.m.HookConnect(func(s *Session) {
+		sessions <- s
+	})
+	server := NewHTTPTestServer(t, HandleNegotiate(srv.m, WithNegotiateLongPoll(WithLongPollBufferSize(4))))
+
+	c := NewLongPollClient(t, server.URL+"?transport=longpoll")
+	s := <-sessions
+
+	// the write pump waits for room in the full queue while the session upgrades
+	n := 40
+	go func() {
+		for i := 1; i <= n; i++ {
+			s.Write([]byte(strconv.Itoa(i)))
 		}
+	}()
+	conn := s.conn.(*pConn)
+	for len(conn.outgoing) < cap(conn.outgoing) {
+		time.Sleep(time.Millisecond)
+	}
 
-		return true
+	ws, err := NewDialer(server.URL + "?session=" + c.token)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer ws.Close()
 
-	if !fn([]byte{2, 3, 5, 7, 11}) {
-		t.Errorf("should not be false")
+	for i := 1; i <= n; i++ {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(i); string(msg) != want {
+			t.Fatalf("upgraded message %s should equal %s", msg, want)
+		}
 	}
 }
 
-func TestStop(t *testing.T) {
-	noecho := NewTestServer()
-	server := httptest.NewServer(noecho)
-	defer server.Close()
+func TestRingBufferWakeup(t *testing.T) {
+	rb := NewRingBuffer(2)
 
-	conn, err := NewDialer(server.URL)
-	defer conn.Close()
+	got := make(chan *envelope)
+	go func() {
+		m, _ := rb.Get()
+		got <- m
+	}()
 
-	if err != nil {
-		t.Error(err)
-	}
+	time.Sleep(10 * time.Millisecond)
 
-	noecho.h.Close()
-}
+	sent := &envelope{t: TextMessage, msg: []byte("test")}
+	if err := rb.Put(sent); err != nil {
+		t.Fatal(err)
+	}
 
-func TestSmallMessageBuffer(t *testing.T) {
-	echo := NewTestServerHandler(func(session *Session, msg []byte) {
-		session.Write(msg)
-	})
-	echo.m.Config.MessageBufferSize = 0
-	echo.m.HandleError(func(s *Session, err error) {
-		if err == nil {
-			t.Error("there should be a buffer full error here")
+	select {
+	case m := <-got:
+		if m != sent {
+			t.Error("parked get should return the put envelope")
 		}
-	})
-	server := httptest.NewServer(echo)
-	defer server.Close()
+	case <-time.After(time.Second):
+		t.Error("put should wake up a parked get")
+	}
+}
 
-	conn, err := NewDialer(server.URL)
-	defer conn.Close()
+func TestRingBufferTimeout(t *testing.T) {
+	rb := NewRingBuffer(2)
 
-	if err != nil {
-		t.Error(err)
+	start := time.Now()
+	if _, err := rb.Get(20 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("get on empty buffer should time out, got %v", err)
 	}
 
-	conn.WriteMessage(websocket.TextMessage, []byte("12345"))
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("get should wait for the timeout")
+	}
 }
 
-func TestPong(t *testing.T) {
-	echo := NewTestServerHandler(func(session *Session, msg []byte) {
-		session.Write(msg)
-	})
-	echo.m.Config.PongWait = time.Second
-	echo.m.Config.PingPeriod = time.Second * 9 / 10
-	server := httptest.NewServer(echo)
-	defer server.Close()
+func TestRingBufferDispose(t *testing.T) {
+	rb := NewRingBuffer(1)
+	_ = rb.Put(&envelope{t: TextMessage})
 
-	conn, err := NewDialer(server.URL)
-	defer conn.Close()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- rb.Put(&envelope{t: TextMessage})
+	}()
+	go func() {
+		// drain the first envelope, the second get parks.
+		_, _ = rb.Get()
+		_, err := rb.Get()
+		errs <- err
+	}()
 
-	if err != nil {
-		t.Error(err)
+	time.Sleep(10 * time.Millisecond)
+	rb.Dispose()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil && err != ErrDisposed {
+				t.Errorf("unexpected error %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("dispose should wake up parked callers")
+		}
 	}
+}
 
-	fired := false
-	echo.m.HandlePong(func(s *Session) {
-		fired = true
-	})
+func BenchmarkIdleSessions(b *testing.B) {
+	m := New()
+	num := 10000
 
-	conn.WriteMessage(websocket.PongMessage, nil)
+	sessions := make([]*Session, num)
+	for i := 0; i < num; i++ {
+		sessions[i] = newTestSession(m)
+		go sessions[i].writePump()
+	}
+	defer func() {
+		for _, s := range sessions {
+			s.close()
+		}
+	}()
 
-	time.Sleep(time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
 
-	if !fired {
-		t.Error("should have fired pong handler")
+	b.ResetTimer()
+	start := cpuTime()
+	for n := 0; n < b.N; n++ {
+		time.Sleep(10 * time.Millisecond)
 	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(cpuTime()-start)/float64(time.Millisecond)/float64(b.N), "cpu-ms/op")
 }
 
 func BenchmarkSessionWrite(b *testing.B) {
@@ -720,3 +4055,61 @@ func BenchmarkBroadcast(b *testing.B) {
 		conns[i].Close()
 	}
 }
+
+func benchmarkBroadcastLarge(b *testing.B, broadcast func(h *Hub, msg []byte)) {
+	echo := NewTestServer()
+	echo.m.Config.MaxMessageSize = 1 << 17
+	echo.options = []GwsOption{WithGwsCompression(true)}
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	conns := make([]*websocket.Conn, 0)
+
+	num := 100
+
+	for i := 0; i < num; i++ {
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for echo.h.Online() < num {
+		time.Sleep(time.Millisecond)
+	}
+
+	msg := []byte(strings.Repeat("test", 1<<14))
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		broadcast(echo.h, msg)
+
+		for i := 0; i < num; i++ {
+			conns[i].ReadMessage()
+		}
+	}
+
+	b.StopTimer()
+	for i := 0; i < num; i++ {
+		conns[i].Close()
+	}
+}
+
+// BenchmarkBroadcastUnprepared frames and compresses the message once per session.
+func BenchmarkBroadcastUnprepared(b *testing.B) {
+	benchmarkBroadcastLarge(b, func(h *Hub, msg []byte) {
+		h.Range(func(s *Session) {
+			s.Write(msg)
+		})
+	})
+}
+
+// BenchmarkBroadcastPrepared frames and compresses the message once per broadcast.
+func BenchmarkBroadcastPrepared(b *testing.B) {
+	benchmarkBroadcastLarge(b, func(h *Hub, msg []byte) {
+		h.Broadcast(msg)
+	})
+}
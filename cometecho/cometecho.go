@@ -0,0 +1,79 @@
+// Package cometecho serves comet sessions on echo routes.
+//
+// Example
+//
+//	m := comet.New()
+//	e := echo.New()
+//	e.GET("/rooms/:room/ws", cometecho.Handle(m))
+//	e.Any("/sse", cometecho.Wrap(comet.HandleSse(m)))
+package cometecho
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Tooooommy/comet"
+	"github.com/labstack/echo"
+)
+
+type rejectionKey struct{}
+
+// rejection is the http status of a request rejected by the gws handler.
+type rejection struct {
+	status int
+}
+
+// Handle returns an echo handler serving websocket sessions like comet.HandleGws.
+// The route params are set as session keys and rejected upgrades are returned
+// as *echo.HTTPError. The response is left to the echo HTTPErrorHandler, unless
+// options set their own error response with comet.WithGwsErrorResponse, which
+// then writes it.
+func Handle(m *comet.Comet, options ...comet.GwsOption) echo.HandlerFunc {
+	// the error response of options replaces the default one leaving the response to echo
+	options = append([]comet.GwsOption{comet.WithGwsErrorResponse(
+		func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			if rejected, ok := r.Context().Value(rejectionKey{}).(*rejection); ok {
+				rejected.status = status
+			}
+		})}, options...)
+	handler := comet.HandleGws(m, options...)
+
+	return func(c echo.Context) error {
+		rejected := &rejection{}
+		request := withParams(c)
+		request = request.WithContext(context.WithValue(request.Context(), rejectionKey{}, rejected))
+		if err := handler(c.Response(), request); err != nil {
+			if rejected.status == 0 && c.Response().Committed && c.Response().Status >= http.StatusBadRequest {
+				rejected.status = c.Response().Status
+			}
+			if rejected.status != 0 {
+				return echo.NewHTTPError(rejected.status, http.StatusText(rejected.status)).SetInternal(err)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// Wrap returns an echo handler serving fn, which may be any comet transport
+// handler. The route params are set as session keys and errors are returned
+// to echo, rejected requests were already answered by fn.
+func Wrap(fn comet.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return fn(c.Response(), withParams(c))
+	}
+}
+
+// withParams returns the request of c carrying the route params as session keys.
+func withParams(c echo.Context) *http.Request {
+	names := c.ParamNames()
+	if len(names) == 0 {
+		return c.Request()
+	}
+	values := c.ParamValues()
+	keys := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		keys[name] = values[i]
+	}
+	return comet.WithRequestKeys(c.Request(), keys)
+}
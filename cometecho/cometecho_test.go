@@ -0,0 +1,108 @@
+package cometecho
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tooooommy/comet"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+func NewTestServer(t *testing.T, m *comet.Comet, errs chan error, options ...comet.GwsOption) *httptest.Server {
+	e := echo.New()
+	handleError := e.HTTPErrorHandler
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		errs <- err
+		handleError(err, c)
+	}
+	e.GET("/rooms/:room/ws", Handle(m, options...))
+	e.GET("/wrap/:room", Wrap(comet.HandleGws(m)))
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandle(t *testing.T) {
+	m := comet.New()
+	rooms := make(chan string, 2)
+	m.HandleConnect(func(s *comet.Session) {
+		rooms <- s.GetString("room")
+	})
+	server := NewTestServer(t, m, make(chan error, 1))
+
+	for _, path := range []string{"/rooms/gophers/ws", "/wrap/gophers"} {
+		conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1)+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room := <-rooms; room != "gophers" {
+			t.Errorf("%s: session room %q should equal gophers", path, room)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandleRejected(t *testing.T) {
+	m := comet.New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		return nil, comet.ErrForbidden
+	})
+	errs := make(chan error, 1)
+	server := NewTestServer(t, m, errs)
+
+	res, err := http.Get(server.URL + "/rooms/gophers/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d should equal %d", res.StatusCode, http.StatusForbidden)
+	}
+	var httpErr *echo.HTTPError
+	if err := <-errs; !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden || !errors.Is(httpErr.Internal, comet.ErrForbidden) {
+		t.Errorf("echo error %v should be a forbidden *echo.HTTPError", err)
+	}
+
+	res, err = http.Get(server.URL + "/wrap/gophers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("wrapped status %d should equal %d", res.StatusCode, http.StatusForbidden)
+	}
+	if err := <-errs; !errors.Is(err, comet.ErrForbidden) {
+		t.Errorf("wrapped echo error %v should be %v", err, comet.ErrForbidden)
+	}
+}
+
+func TestHandleErrorResponse(t *testing.T) {
+	m := comet.New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		return nil, comet.ErrForbidden
+	})
+	errs := make(chan error, 1)
+	server := NewTestServer(t, m, errs, comet.WithGwsErrorResponse(func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		http.Error(w, "custom", status)
+	}))
+
+	res, err := http.Get(server.URL + "/rooms/gophers/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || strings.TrimSpace(string(body)) != "custom" {
+		t.Errorf("response %d %q should be the custom error response", res.StatusCode, body)
+	}
+	var httpErr *echo.HTTPError
+	if err := <-errs; !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden || !errors.Is(httpErr.Internal, comet.ErrForbidden) {
+		t.Errorf("echo error %v should be a forbidden *echo.HTTPError", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Package cometgin serves comet sessions on gin routes.
+//
+// Example
+//
+//	m := comet.New()
+//	r := gin.Default()
+//	r.GET("/rooms/:room/ws", cometgin.Handle(m))
+//	r.Any("/sse", cometgin.Wrap(comet.HandleSse(m)))
+package cometgin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Tooooommy/comet"
+	"github.com/gin-gonic/gin"
+)
+
+type rejectionKey struct{}
+
+// rejection is the http status of a request rejected by the gws handler.
+type rejection struct {
+	status int
+}
+
+// Handle returns a gin handler serving websocket sessions like comet.HandleGws.
+// The route params are set as session keys and rejected upgrades are aborted
+// with c.AbortWithError. The response is left to the gin error handling, unless
+// options set their own error response with comet.WithGwsErrorResponse, which
+// then writes it.
+func Handle(m *comet.Comet, options ...comet.GwsOption) gin.HandlerFunc {
+	// the error response of options replaces the default one leaving the response to gin
+	options = append([]comet.GwsOption{comet.WithGwsErrorResponse(
+		func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			if rejected, ok := r.Context().Value(rejectionKey{}).(*rejection); ok {
+				rejected.status = status
+			}
+		})}, options...)
+	handler := comet.HandleGws(m, options...)
+
+	return func(c *gin.Context) {
+		rejected := &rejection{}
+		request := withParams(c)
+		request = request.WithContext(context.WithValue(request.Context(), rejectionKey{}, rejected))
+		if err := handler(c.Writer, request); err != nil {
+			if rejected.status == 0 && c.Writer.Written() && c.Writer.Status() >= http.StatusBadRequest {
+				rejected.status = c.Writer.Status()
+			}
+			if rejected.status != 0 {
+				_ = c.AbortWithError(rejected.status, err)
+				return
+			}
+			_ = c.Error(err)
+		}
+	}
+}
+
+// Wrap returns a gin handler serving fn, which may be any comet transport
+// handler. The route params are set as session keys and errors are added to
+// the gin context, rejected requests were already answered by fn.
+func Wrap(fn comet.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := fn(c.Writer, withParams(c)); err != nil {
+			_ = c.Error(err)
+		}
+	}
+}
+
+// withParams returns the request of c carrying the route params as session keys.
+func withParams(c *gin.Context) *http.Request {
+	if len(c.Params) == 0 {
+		return c.Request
+	}
+	keys := make(map[string]interface{}, len(c.Params))
+	for _, param := range c.Params {
+		keys[param.Key] = param.Value
+	}
+	return comet.WithRequestKeys(c.Request, keys)
+}
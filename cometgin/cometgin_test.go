@@ -0,0 +1,105 @@
+package cometgin
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tooooommy/comet"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func NewTestServer(t *testing.T, m *comet.Comet, errs chan error, options ...comet.GwsOption) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		if err := c.Errors.Last(); err != nil {
+			errs <- err.Err
+		}
+	})
+	r.GET("/rooms/:room/ws", Handle(m, options...))
+	r.GET("/wrap/:room", Wrap(comet.HandleGws(m)))
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandle(t *testing.T) {
+	m := comet.New()
+	rooms := make(chan string, 2)
+	m.HandleConnect(func(s *comet.Session) {
+		rooms <- s.GetString("room")
+	})
+	server := NewTestServer(t, m, make(chan error, 1))
+
+	for _, path := range []string{"/rooms/gophers/ws", "/wrap/gophers"} {
+		conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1)+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room := <-rooms; room != "gophers" {
+			t.Errorf("%s: session room %q should equal gophers", path, room)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandleRejected(t *testing.T) {
+	m := comet.New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		return nil, comet.ErrForbidden
+	})
+	errs := make(chan error, 1)
+	server := NewTestServer(t, m, errs)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/rooms/gophers/ws", http.StatusForbidden},
+		{"/wrap/gophers", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		res, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: status %d should equal %d", test.path, res.StatusCode, test.status)
+		}
+		if err := <-errs; !errors.Is(err, comet.ErrForbidden) {
+			t.Errorf("%s: gin error %v should be %v", test.path, err, comet.ErrForbidden)
+		}
+	}
+}
+
+func TestHandleErrorResponse(t *testing.T) {
+	m := comet.New()
+	m.HandleAuthenticate(func(r *http.Request) (map[string]interface{}, error) {
+		return nil, comet.ErrForbidden
+	})
+	errs := make(chan error, 1)
+	server := NewTestServer(t, m, errs, comet.WithGwsErrorResponse(func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		http.Error(w, "custom", status)
+	}))
+
+	res, err := http.Get(server.URL + "/rooms/gophers/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || strings.TrimSpace(string(body)) != "custom" {
+		t.Errorf("response %d %q should be the custom error response", res.StatusCode, body)
+	}
+	if err := <-errs; !errors.Is(err, comet.ErrForbidden) {
+		t.Errorf("gin error %v should be %v", err, comet.ErrForbidden)
+	}
+}
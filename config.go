@@ -1,15 +1,51 @@
 package comet
 
-import "time"
+import (
+	"compress/flate"
+	"time"
+)
+
+// SlowConsumerPolicy decides what happens to a message written to a session
+// whose message buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDropNewest drops the message being written.
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+
+	// SlowConsumerDropOldest drops the oldest queued message to make room.
+	SlowConsumerDropOldest
+
+	// SlowConsumerBlock waits up to SlowConsumerWait for room in the buffer,
+	// then drops the message being written.
+	SlowConsumerBlock
+
+	// SlowConsumerDisconnect closes the session with SlowConsumerCode.
+	SlowConsumerDisconnect
+
+	// SlowConsumerCoalesce replaces a queued message with the same CoalesceKey
+	// instead of queueing another one. Messages without a key are dropped
+	// when the buffer is full.
+	SlowConsumerCoalesce
+)
 
 // Conf comet configuration struct.
 type (
 	Conf struct {
-		WriteWait         time.Duration // Milliseconds until write times out.
-		PongWait          time.Duration // Timeout for waiting on pong.
-		PingPeriod        time.Duration // Milliseconds between pings.
-		MaxMessageSize    int64         // Maximum size in bytes of a message.
-		MessageBufferSize uint64        // The max amount of messages that can be in a sessions buffer before it starts dropping them.
+		WriteWait         time.Duration           // Milliseconds until write times out.
+		PongWait          time.Duration           // Timeout for waiting on pong.
+		PingPeriod        time.Duration           // Milliseconds between pings.
+		MaxMessageSize    int64                   // Maximum size in bytes of a message.
+		MessageBufferSize uint64                  // The max amount of messages that can be in a sessions buffer before SlowConsumer applies.
+		SlowConsumer      SlowConsumerPolicy      // What to do with a message when a sessions buffer is full.
+		SlowConsumerWait  time.Duration           // How long SlowConsumerBlock waits for room in the buffer.
+		SlowConsumerCode  int                     // Close code sent to sessions disconnected by SlowConsumerDisconnect.
+		CoalesceKey       func([]byte) string     // Key of a message for SlowConsumerCoalesce, an empty key is never coalesced.
+		CompressThreshold int                     // Messages smaller than this many bytes are not compressed, 0 compresses every message the session supports compression for.
+		CompressLevel     int                     // Flate compression level of compressed messages, see compress/flate.
+		SessionID         func(*Handshake) string // Generates the unique ID of a new session.
+		EventCodec        EventCodec              // Encodes and decodes the events routed with Comet.On and sent with Session.Emit.
+		CallTimeout       time.Duration           // How long Session.Call waits for an answer, 0 only waits for its context.
 	}
 )
 
@@ -20,5 +56,14 @@ func newConf() *Conf {
 		PingPeriod:        (60 * time.Second * 9) / 10,
 		MaxMessageSize:    1024,
 		MessageBufferSize: 1024,
+		SlowConsumer:      SlowConsumerDropNewest,
+		SlowConsumerWait:  time.Second,
+		SlowConsumerCode:  ClosePolicyViolation,
+		CoalesceKey:       func([]byte) string { return "" },
+		CompressThreshold: 0,
+		CompressLevel:     flate.BestSpeed,
+		SessionID:         newSessionID,
+		EventCodec:        JSONCodec{},
+		CallTimeout:       30 * time.Second,
 	}
 }
@@ -1,6 +1,7 @@
 package comet
 
 import (
+	"fmt"
 	"net"
 	"time"
 )
@@ -29,14 +30,39 @@ const (
 	// PongMessage denotes a pong control message. The optional message payload
 	// is UTF-8 encoded text.
 	PongMessage = 10
-
 )
 
+// Close codes defined in RFC 6455, section 11.7.
 const (
-	CloseNoStatusReceived        = 0
+	CloseNoStatusReceived = 0
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	ClosePolicyViolation  = 1008
 )
 
+// CloseError is returned by Conn.ReadMessage when a close frame is received.
+type CloseError struct {
+	// Code is defined in RFC 6455, section 11.7.
+	Code int
+
+	// Text is the optional text payload.
+	Text string
+}
 
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("close %d %s", e.Code, e.Text)
+}
+
+// Compressor is implemented by connections that can compress the messages they write.
+// The websocket Conn only compresses when per message compression was negotiated.
+type Compressor interface {
+	// EnableWriteCompression enables and disables compression of subsequent text
+	// and binary messages.
+	EnableWriteCompression(enable bool)
+
+	// SetCompressionLevel sets the flate compression level for subsequent messages.
+	SetCompressionLevel(level int) error
+}
 
 // 仿照WebSocket Conn
 type Conn interface {
@@ -47,7 +73,7 @@ type Conn interface {
 	Close() error
 	SetReadLimit(int64)
 	SetReadDeadline(time.Time) error
-	ReadMessage()(int, []byte, error)
+	ReadMessage() (int, []byte, error)
 	SetPongHandler(func(string) error)
 	SetPingHandler(func(string) error)
 	SetCloseHandler(func(int, string) error)
@@ -0,0 +1,8 @@
+package comet
+
+import "time"
+
+// cpuTime is not measured on windows.
+func cpuTime() time.Duration {
+	return 0
+}
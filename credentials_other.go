@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package comet
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is not supported outside of linux.
+func peerCredentials(conn *net.UnixConn) (*Credentials, error) {
+	return nil, errors.New("comet: peer credentials are not supported on this platform")
+}
@@ -11,12 +11,17 @@
 //  func main() {
 //  	r := gin.Default()
 //  	m := comet.New()
-//  	r.GET("/ws", func(c *gin.Context) {
-//  		m.HandleRequest(c.Writer, c.req)
-//  	})
+//  	h := comet.NewHub()
+//  	m.HookConnect(h.Register)
+//  	m.HookDisconnect(h.Unregister)
+//  	r.GET("/ws", cometgin.Handle(m))
 //  	m.HandleMessage(func(s *comet.Session, msg []byte) {
-//  		m.Broadcast(msg)
+//  		h.Broadcast(msg)
 //  	})
 //  	r.Run(":5000")
 //  }
+//
+// Comet is an http.Handler serving websockets, so it can also be mounted with
+// http.Handle("/ws", m), or with http.Handle("/ws", m.Handler(options...)) to
+// configure the upgrades, e.g. the accepted origins.
 package comet
@@ -1,7 +1,86 @@
 package comet
 
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
 type envelope struct {
 	t      int
 	msg    []byte
 	filter filterFunc
+	room   string
+	key    string
+	// compress forces compression regardless of the size threshold.
+	compress bool
+	// prepared caches the encoded frames of msg when it is sent to many sessions.
+	prepared *PreparedMessage
+	// report collects the delivery of a broadcast, if requested.
+	report *reporter
+}
+
+// prepare returns the envelope of a message sent to many sessions.
+func prepare(t int, msg []byte) *envelope {
+	return &envelope{t: t, msg: msg, prepared: NewPreparedMessage(t, msg)}
+}
+
+// Preparer is implemented by connections that can write a PreparedMessage.
+type Preparer interface {
+	WritePreparedMessage(pm *PreparedMessage) error
+}
+
+// PreparedMessage caches the on the wire representations of a message so a
+// message sent to many sessions is framed, and compressed, once per transport
+// instead of once per session. The hub broadcasts prepared messages.
+type PreparedMessage struct {
+	t     int
+	msg   []byte
+	mutex sync.Mutex
+	gws   *websocket.PreparedMessage
+	tcp   map[tcpFrameKey][]byte
+}
+
+type tcpFrameKey struct {
+	compress bool
+	level    int
+}
+
+// NewPreparedMessage returns a prepared text or binary message.
+func NewPreparedMessage(t int, msg []byte) *PreparedMessage {
+	return &PreparedMessage{t: t, msg: msg}
+}
+
+// gorilla returns the websocket prepared message, it caches its frames per
+// compression setting itself.
+func (pm *PreparedMessage) gorilla() (*websocket.PreparedMessage, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if pm.gws == nil {
+		prepared, err := websocket.NewPreparedMessage(pm.t, pm.msg)
+		if err != nil {
+			return nil, err
+		}
+		pm.gws = prepared
+	}
+	return pm.gws, nil
+}
+
+// frame returns the tcp frame of the message, building it with build once
+// per compression setting.
+func (pm *PreparedMessage) frame(key tcpFrameKey, build func() ([]byte, error)) ([]byte, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if frame, ok := pm.tcp[key]; ok {
+		return frame, nil
+	}
+	frame, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if pm.tcp == nil {
+		pm.tcp = make(map[tcpFrameKey][]byte)
+	}
+	pm.tcp[key] = frame
+	return frame, nil
 }
@@ -0,0 +1,193 @@
+package comet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrorEvent is the event the default event error handler replies with.
+const ErrorEvent = "error"
+
+// ErrUnknownEvent is passed to the event error handler for events without a
+// handler when no message handler is set either.
+var ErrUnknownEvent = errors.New("comet: unknown event")
+
+// EventCodec encodes and decodes the envelopes of events routed with Comet.On
+// and sent with Session.Emit.
+type EventCodec interface {
+	// Encode returns the message of event with data v.
+	Encode(event string, v interface{}) ([]byte, error)
+	// Decode returns the event of msg and its still encoded data.
+	Decode(msg []byte) (event string, data []byte, err error)
+	// Unmarshal decodes the data returned by Decode into v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default EventCodec, events are encoded as
+// {"event": "chat.send", "data": {...}}.
+type JSONCodec struct{}
+
+type jsonEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Encode returns the JSON envelope of event with data v.
+func (JSONCodec) Encode(event string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonEvent{Event: event, Data: data})
+}
+
+// Decode returns the event of a JSON envelope and its raw data,
+// messages without an event are not envelopes.
+func (JSONCodec) Decode(msg []byte) (string, []byte, error) {
+	var e jsonEvent
+	if err := json.Unmarshal(msg, &e); err != nil {
+		return "", nil, err
+	}
+	if e.Event == "" {
+		return "", nil, errors.New("comet: message has no event")
+	}
+	return e.Event, e.Data, nil
+}
+
+// Unmarshal decodes JSON data into v, missing data leaves v unchanged.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// EventError is the data of the error event replied by the default event error handler.
+type EventError struct {
+	Event string `json:"event"`
+	Error string `json:"error"`
+}
+
+// eventHandler is a func(*Session, T) error registered with Comet.On.
+type eventHandler struct {
+	fn   reflect.Value
+	data reflect.Type
+}
+
+var (
+	sessionType = reflect.TypeOf((*Session)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// handlerFunc checks that fn is a func(*Session, T) returning results, a nil
+// result accepts any type. It is shared by On, OnCall and NewMethod so their
+// signature rules do not drift apart.
+func handlerFunc(fn interface{}, results ...reflect.Type) (reflect.Value, error) {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() {
+		return v, errors.New("handler is nil")
+	}
+	t := v.Type()
+	ok := t.Kind() == reflect.Func && t.NumIn() == 2 && t.In(0) == sessionType && t.NumOut() == len(results)
+	for i := 0; ok && i < len(results); i++ {
+		ok = results[i] == nil || t.Out(i) == results[i]
+	}
+	if !ok {
+		return v, fmt.Errorf("got %s", t)
+	}
+	return v, nil
+}
+
+// On routes text messages whose event, as decoded by Conf.EventCodec, equals event
+// to fn, which must be a func(*Session, T) error. The event data is decoded into
+// a new T. Errors returned by fn, and events without a handler, are passed to the
+// event error handler. Text messages that are not events still fire the
+// HandleMessage handler, so raw handlers keep working next to the router.
+func (m *Comet) On(event string, fn interface{}) {
+	v, err := handlerFunc(fn, errorType)
+	if err != nil {
+		panic(fmt.Sprintf("comet: handler of event %q must be a func(*Session, T) error, %v", event, err))
+	}
+
+	if m.events == nil {
+		m.events = make(map[string]*eventHandler)
+	}
+	m.events[event] = &eventHandler{fn: v, data: v.Type().In(1)}
+}
+
+// HandleEventError fires fn when an event handler returns an error or an event has
+// neither an event handler nor a message handler, in which case err is
+// ErrUnknownEvent. The default handler replies with an ErrorEvent whose data is
+// an EventError.
+func (m *Comet) HandleEventError(fn func(*Session, string, error)) {
+	m.eventErrorHandler = fn
+}
+
+// emitError is the default event error handler.
+func emitError(s *Session, event string, err error) {
+	_ = s.Emit(ErrorEvent, &EventError{Event: event, Error: err.Error()})
+}
+
+// dispatch routes a text message to its event or call handler, or to the message
+// handler if nothing is routed, the message is not an event or its event has no handler.
+func (m *Comet) dispatch(s *Session, msg []byte) {
+	if len(m.events) == 0 && len(m.calls) == 0 && s.pending() == 0 {
+		m.message(s, msg)
+		return
+	}
+
+	codec := m.Config.EventCodec
+	event, data, err := codec.Decode(msg)
+	if err != nil {
+		m.message(s, msg)
+		return
+	}
+
+	switch {
+	case event == ResultEvent:
+		s.resolve(data)
+		return
+	case event == CallEvent && len(m.calls) > 0:
+		m.answer(s, data)
+		return
+	}
+
+	handler, ok := m.events[event]
+	if !ok && m.messageHandler != nil {
+		m.messageHandler(s, msg)
+		return
+	}
+	if !ok {
+		m.eventErrorHandler(s, event, ErrUnknownEvent)
+		return
+	}
+
+	payload := reflect.New(handler.data)
+	if err := codec.Unmarshal(data, payload.Interface()); err != nil {
+		m.eventErrorHandler(s, event, err)
+		return
+	}
+
+	out := handler.fn.Call([]reflect.Value{reflect.ValueOf(s), payload.Elem()})
+	if err, _ := out[0].Interface().(error); err != nil {
+		m.eventErrorHandler(s, event, err)
+	}
+}
+
+// message passes msg to the message handler, if any.
+func (m *Comet) message(s *Session, msg []byte) {
+	if m.messageHandler != nil {
+		m.messageHandler(s, msg)
+	}
+}
+
+// Emit writes event with data v to session, encoded with Conf.EventCodec.
+func (s *Session) Emit(event string, v interface{}) error {
+	msg, err := s.comet.Config.EventCodec.Encode(event, v)
+	if err != nil {
+		return err
+	}
+	return s.Write(msg)
+}
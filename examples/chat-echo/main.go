@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/Tooooommy/comet"
+	"github.com/Tooooommy/comet/cometecho"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"net/http"
@@ -27,9 +28,7 @@ func main() {
 		return nil
 	})
 
-	e.GET("/ws", func(c echo.Context) error {
-		return comet.HandleRequest(m)(c.Response(), c.Request())
-	})
+	e.GET("/ws", cometecho.Handle(m))
 
 	m.HandleMessage(func(s *comet.Session, msg []byte) {
 		_ = h.Broadcast(msg)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/Tooooommy/comet"
+	"github.com/Tooooommy/comet/cometgin"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -21,9 +22,7 @@ func main() {
 		http.ServeFile(c.Writer, c.Request, "index.html")
 	})
 
-	r.GET("/ws", func(c *gin.Context) {
-		_ = comet.HandleRequest(m)(c.Writer, c.Request)
-	})
+	r.GET("/ws", cometgin.Handle(m))
 
 	m.HandleMessage(func(s *comet.Session, msg []byte) {
 		_ = h.Broadcast(msg)
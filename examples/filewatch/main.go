@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/Tooooommy/comet"
+	"github.com/Tooooommy/comet/cometgin"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
@@ -14,21 +15,15 @@ func main() {
 	r := gin.Default()
 	m := comet.New()
 	h := comet.NewHub()
-	m.HandleConnect(func(session *comet.Session) {
-		h.Register(session)
-	})
-	m.HandleDisconnect(func(session *comet.Session) {
-		h.Unregister(session)
-	})
+	m.HookConnect(h.Register)
+	m.HookDisconnect(h.Unregister)
 	w, _ := fsnotify.NewWatcher()
 
 	r.GET("/", func(c *gin.Context) {
 		http.ServeFile(c.Writer, c.Request, "index.html")
 	})
 
-	r.GET("/ws", func(c *gin.Context) {
-		_ = comet.HandleRequest(m)(c.Writer, c.Request)
-	})
+	r.GET("/ws", cometgin.Handle(m))
 
 	m.HandleConnect(func(s *comet.Session) {
 		content, _ := ioutil.ReadFile(file)
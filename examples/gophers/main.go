@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/Tooooommy/comet"
+	"github.com/Tooooommy/comet/cometgin"
 	"github.com/gin-gonic/gin"
 )
 
@@ -27,9 +28,7 @@ func main() {
 		http.ServeFile(c.Writer, c.Request, "index.html")
 	})
 
-	router.GET("/ws", func(c *gin.Context) {
-		_ = comet.HandleRequest(m)(c.Writer, c.Request)
-	})
+	router.GET("/ws", cometgin.Handle(m))
 
 	m.HandleConnect(func(s *comet.Session) {
 		h.Register(s)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/Tooooommy/comet"
+	"github.com/Tooooommy/comet/cometgin"
 	"github.com/gin-gonic/gin"
 	"net/http"
 )
@@ -19,12 +20,10 @@ func main() {
 		http.ServeFile(c.Writer, c.Request, "chan.html")
 	})
 
-	r.GET("/channel/:name/ws", func(c *gin.Context) {
-		_ = comet.HandleRequest(m)(c.Writer, c.Request)
-	})
+	r.GET("/channel/:name/ws", cometgin.Handle(m))
 
 	m.HandleConnect(func(session *comet.Session) {
-		h.Register(session)
+		h.Join(session, session.GetString("name"))
 	})
 
 	m.HandleDisconnect(func(session *comet.Session) {
@@ -32,9 +31,7 @@ func main() {
 	})
 
 	m.HandleMessage(func(s *comet.Session, msg []byte) {
-		_ = h.BroadcastFilter(msg, func(q *comet.Session) bool {
-			return q.Request().URL.Path == s.Request().URL.Path
-		})
+		_ = h.BroadcastRoom(s.GetString("name"), msg)
 	})
 
 	_ = r.Run(":5000")
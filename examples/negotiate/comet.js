@@ -0,0 +1,237 @@
+// Reference client of comet.HandleNegotiate.
+//
+// It connects with the best transport offered by the server and supported by
+// the browser, falling back from websocket to sse to longpoll, and upgrades
+// long-polling sessions to websockets without losing messages.
+//
+//   var comet = new Comet("/comet");
+//   comet.onopen = function (transport) {};
+//   comet.onmessage = function (data) {}; // a string, or a Uint8Array for binary messages
+//   comet.onclose = function (code, reason) {};
+//   comet.connect();
+//   comet.send("hello");
+(function (global) {
+  "use strict";
+
+  var supported = {
+    websocket: typeof WebSocket !== "undefined",
+    sse: typeof EventSource !== "undefined",
+    longpoll: typeof fetch !== "undefined",
+  };
+
+  function Comet(url, options) {
+    this.url = new URL(url, global.location.href);
+    this.transports = (options && options.transports) || ["websocket", "sse", "longpoll"];
+    this.transport = null;
+    this.onopen = function () {};
+    this.onmessage = function () {};
+    this.onclose = function () {};
+  }
+
+  Comet.prototype.endpoint = function (params, websocket) {
+    var url = new URL(this.url.href);
+    Object.keys(params).forEach(function (key) {
+      url.searchParams.set(key, params[key]);
+    });
+    if (websocket) {
+      url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+    }
+    return url.href;
+  };
+
+  // connect asks the server for its transports and opens the first one that works.
+  Comet.prototype.connect = function () {
+    var self = this;
+    return fetch(this.endpoint({}))
+      .then(function (res) { return res.json(); })
+      .then(function (negotiated) {
+        var transports = negotiated.transports.filter(function (transport) {
+          return supported[transport] && self.transports.indexOf(transport) >= 0;
+        });
+        self.offered = transports;
+        return self.fallback(transports);
+      });
+  };
+
+  Comet.prototype.fallback = function (transports) {
+    var self = this;
+    if (transports.length === 0) {
+      return Promise.reject(new Error("comet: no transport available"));
+    }
+    var open = { websocket: this.openWebsocket, sse: this.openSse, longpoll: this.openLongPoll }[transports[0]];
+    return open.call(this).then(function () {
+      self.transport = transports[0];
+      self.onopen(self.transport);
+    }, function () {
+      return self.fallback(transports.slice(1));
+    });
+  };
+
+  Comet.prototype.openWebsocket = function (params) {
+    var self = this;
+    return new Promise(function (resolve, reject) {
+      var ws = new WebSocket(self.endpoint(params || {}, true));
+      ws.binaryType = "arraybuffer";
+      ws.onopen = function () {
+        ws.onerror = null;
+        self.ws = ws;
+        resolve();
+      };
+      ws.onerror = reject;
+      ws.onmessage = function (e) {
+        self.onmessage(typeof e.data === "string" ? e.data : new Uint8Array(e.data));
+      };
+      ws.onclose = function (e) {
+        if (self.ws === ws) {
+          self.onclose(e.code, e.reason);
+        }
+      };
+    });
+  };
+
+  Comet.prototype.openSse = function () {
+    var self = this;
+    return new Promise(function (resolve, reject) {
+      var source = new EventSource(self.endpoint({ transport: "sse" }));
+      source.addEventListener("open", function (e) {
+        if (e.data) {
+          self.source = source;
+          self.token = e.data;
+          resolve();
+        }
+      });
+      source.onerror = function () {
+        if (!self.source) {
+          source.close();
+          reject(new Error("comet: sse unavailable"));
+        }
+      };
+      source.onmessage = function (e) {
+        self.onmessage(e.data);
+      };
+      source.addEventListener("binary", function (e) {
+        self.onmessage(decode(e.data));
+      });
+      source.addEventListener("close", function (e) {
+        source.close();
+        closed(self, e.data);
+      });
+    });
+  };
+
+  Comet.prototype.openLongPoll = function () {
+    var self = this;
+    return fetch(this.endpoint({ transport: "longpoll" }))
+      .then(function (res) {
+        if (!res.ok) {
+          throw new Error("comet: longpoll unavailable");
+        }
+        return res.json();
+      })
+      .then(function (opened) {
+        self.token = opened.session;
+        self.ack = 0;
+        self.poll();
+        if (self.offered.indexOf("websocket") >= 0) {
+          setTimeout(function () { self.upgrade(); }, 0);
+        }
+      });
+  };
+
+  // poll polls the messages of a long-polling session until it closes or upgrades.
+  Comet.prototype.poll = function () {
+    var self = this;
+    this.polling = new AbortController();
+    fetch(this.endpoint({ transport: "longpoll", session: this.token, ack: this.ack }), { signal: this.polling.signal })
+      .then(function (res) {
+        if (!res.ok) {
+          throw new Error("comet: poll failed with " + res.status);
+        }
+        return res.json();
+      })
+      .then(function (messages) {
+        var closing = false;
+        messages.forEach(function (msg) {
+          if (msg.seq <= self.ack) {
+            return;
+          }
+          self.ack = msg.seq;
+          if (msg.type === "close") {
+            closing = true;
+            closed(self, msg.data);
+          } else {
+            self.onmessage(msg.type === "binary" ? decode(msg.data) : msg.data);
+          }
+        });
+        if (!closing) {
+          self.poll();
+        }
+      })
+      .catch(function (err) {
+        if (err.name !== "AbortError" && self.transport === "longpoll") {
+          self.transport = null;
+          self.onclose(1006, err.message);
+        }
+      });
+  };
+
+  // upgrade moves a long-polling session to a websocket, polling resumes if it fails.
+  Comet.prototype.upgrade = function () {
+    var self = this;
+    this.polling.abort();
+    return this.openWebsocket({ session: this.token, ack: this.ack }).then(function () {
+      self.transport = "websocket";
+      self.onopen(self.transport);
+    }, function () {
+      self.poll();
+    });
+  };
+
+  // send sends a string, ArrayBuffer or Uint8Array message.
+  Comet.prototype.send = function (data) {
+    if (this.transport === "websocket") {
+      this.ws.send(data);
+      return Promise.resolve();
+    }
+    var binary = typeof data !== "string";
+    var params = { session: this.token };
+    if (this.transport === "sse") {
+      params.transport = "sse";
+    }
+    return fetch(this.endpoint(params), {
+      method: "POST",
+      headers: { "Content-Type": binary ? "application/octet-stream" : "text/plain" },
+      body: data,
+    });
+  };
+
+  Comet.prototype.close = function () {
+    if (this.transport === "websocket") {
+      this.ws.close(1000);
+    } else if (this.transport === "sse") {
+      this.source.close();
+    } else if (this.transport === "longpoll") {
+      this.polling.abort();
+      fetch(this.endpoint({ session: this.token }), { method: "DELETE" });
+    }
+    this.transport = null;
+  };
+
+  function decode(base64) {
+    var raw = atob(base64);
+    var bytes = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+      bytes[i] = raw.charCodeAt(i);
+    }
+    return bytes;
+  }
+
+  // closed reports a "code reason" close message.
+  function closed(comet, data) {
+    var space = data.indexOf(" ");
+    comet.transport = null;
+    comet.onclose(parseInt(data, 10), space < 0 ? "" : data.slice(space + 1));
+  }
+
+  global.Comet = Comet;
+})(window);
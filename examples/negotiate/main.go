@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Tooooommy/comet"
+)
+
+func main() {
+	m := comet.New()
+	h := comet.NewHub()
+	m.HandleConnect(func(session *comet.Session) {
+		h.Register(session)
+	})
+
+	m.HandleDisconnect(func(session *comet.Session) {
+		h.Unregister(session)
+	})
+
+	m.HandleMessage(func(s *comet.Session, msg []byte) {
+		_ = h.Broadcast(msg)
+	})
+
+	negotiate := comet.HandleNegotiate(m)
+	http.HandleFunc("/comet", func(w http.ResponseWriter, r *http.Request) {
+		_ = negotiate(w, r)
+	})
+	http.HandleFunc("/comet.js", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "comet.js")
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "index.html")
+	})
+
+	_ = http.ListenAndServe(":5000", nil)
+}
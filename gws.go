@@ -1,39 +1,214 @@
 package comet
 
 import (
-	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+// HandlerFunc serves the requests of a transport, the error tells why a request
+// was rejected or why its session could not be established.
 type HandlerFunc func(http.ResponseWriter, *http.Request) error
 
+// ServeHTTP calls fn(w, r), so a HandlerFunc is an http.Handler. Its error is
+// dropped, rejected requests were already answered.
+func (fn HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = fn(w, r)
+}
+
+// errorResponse writes the http error response of rejected requests, a nil
+// errorResponse writes the status text.
+type errorResponse func(w http.ResponseWriter, r *http.Request, status int, reason error)
+
+// reject writes an http error response for rejected requests.
+func (fn errorResponse) reject(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	if fn != nil {
+		fn(w, r, status, reason)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+type (
+	gwsOption struct {
+		readBufferSize    int
+		writeBufferSize   int
+		writeBufferPool   websocket.BufferPool
+		handshakeTimeout  time.Duration
+		subprotocols      []string
+		enableCompression bool
+		checkOrigin       func(*http.Request) bool
+		errorResponse
+	}
+
+	GwsOption func(*gwsOption)
+)
+
+func newGwsOption() *gwsOption {
+	return &gwsOption{
+		readBufferSize:  1024,
+		writeBufferSize: 1024,
+		checkOrigin:     func(r *http.Request) bool { return true },
+	}
+}
+
+// WithGwsBufferSize sets the upgrader read and write buffer sizes in bytes.
+func WithGwsBufferSize(read, write int) GwsOption {
+	return func(option *gwsOption) {
+		option.readBufferSize = read
+		option.writeBufferSize = write
+	}
+}
+
+// WithGwsWriteBufferPool shares write buffers between connections, the
+// buffers are only held while a message is being written.
+func WithGwsWriteBufferPool(pool websocket.BufferPool) GwsOption {
+	return func(option *gwsOption) {
+		option.writeBufferPool = pool
+	}
+}
+
+// WithGwsHandshakeTimeout sets the timeout for the upgrade handshake.
+func WithGwsHandshakeTimeout(timeout time.Duration) GwsOption {
+	return func(option *gwsOption) {
+		option.handshakeTimeout = timeout
+	}
+}
+
+// WithGwsSubprotocols sets the server supported subprotocols in order of preference,
+// the negotiated one is available from Session.Handshake.
+func WithGwsSubprotocols(protocols ...string) GwsOption {
+	return func(option *gwsOption) {
+		option.subprotocols = protocols
+	}
+}
+
+// WithGwsCompression enables negotiation of per message compression (RFC 7692),
+// which messages are compressed is decided by Conf.CompressThreshold and
+// Session.WriteCompressed.
+func WithGwsCompression(enable bool) GwsOption {
+	return func(option *gwsOption) {
+		option.enableCompression = enable
+	}
+}
+
+// WithGwsOrigins only accepts requests whose Origin header is one of origins,
+// e.g. "https://example.com". Requests without an Origin header are not sent
+// by browsers and are always accepted. By default any origin is accepted.
+func WithGwsOrigins(origins ...string) GwsOption {
+	return func(option *gwsOption) {
+		option.checkOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range origins {
+				if allowed == "*" || strings.EqualFold(allowed, origin) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// WithGwsCheckOrigin sets the function deciding whether the request Origin is accepted.
+func WithGwsCheckOrigin(fn func(*http.Request) bool) GwsOption {
+	return func(option *gwsOption) {
+		option.checkOrigin = fn
+	}
+}
+
+// WithGwsErrorResponse sets the function writing the http error response
+// when the upgrade fails.
+func WithGwsErrorResponse(fn func(w http.ResponseWriter, r *http.Request, status int, reason error)) GwsOption {
+	return func(option *gwsOption) {
+		option.errorResponse = fn
+	}
+}
+
+// upgrader returns the websocket upgrader configured by option.
+func (option *gwsOption) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    option.readBufferSize,
+		WriteBufferSize:   option.writeBufferSize,
+		WriteBufferPool:   option.writeBufferPool,
+		HandshakeTimeout:  option.handshakeTimeout,
+		Subprotocols:      option.subprotocols,
+		EnableCompression: option.enableCompression,
+		CheckOrigin:       option.checkOrigin,
+		Error:             option.errorResponse,
+	}
+}
+
+// negotiatedCompression reports whether the client offered permessage-deflate,
+// which the upgrader accepts when compression is enabled.
+func negotiatedCompression(r *http.Request) bool {
+	for _, extensions := range r.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(extensions, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // gorilla websocket conn
 type gConn struct {
 	*websocket.Conn
 }
 
-func NewGConn(conn *websocket.Conn) Conn  {
+func NewGConn(conn *websocket.Conn) Conn {
 	return &gConn{conn}
 }
 
-func HandleGws(m *Comet) HandlerFunc  {
-	upgrader := &websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+// NetConn returns the underlying connection.
+func (c *gConn) NetConn() net.Conn {
+	return c.UnderlyingConn()
+}
+
+// WritePreparedMessage writes pm, its frame is encoded once per compression setting.
+func (c *gConn) WritePreparedMessage(pm *PreparedMessage) error {
+	prepared, err := pm.gorilla()
+	if err != nil {
+		return err
+	}
+	return c.Conn.WritePreparedMessage(prepared)
+}
+
+func HandleGws(m *Comet, options ...GwsOption) HandlerFunc {
+	opt := newGwsOption()
+	for _, option := range options {
+		option(opt)
 	}
+	upgrader := opt.upgrader()
 	return func(writer http.ResponseWriter, request *http.Request) error {
-		conn, err := upgrader.Upgrade(writer, request, writer.Header())
+		if m.sessions.closed() {
+			opt.reject(writer, request, http.StatusServiceUnavailable, ErrServerClosed)
+			return ErrServerClosed
+		}
+
+		authenticated, status, err := m.authenticate(request)
 		if err != nil {
+			opt.reject(writer, request, status, err)
 			return err
 		}
 
-		keys := map[string]interface{}{}
-		for k, v := range request.Header {
-			keys[k] = v
+		conn, err := upgrader.Upgrade(writer, request, writer.Header())
+		if err != nil {
+			return err
 		}
 
-		m.Handle(NewGConn(conn), keys)
-		return nil
+		keys := requestKeys(request, authenticated)
+		gconn := NewGConn(conn)
+		handshake := NewHandshake(gconn, request)
+		handshake.Subprotocol = conn.Subprotocol()
+		handshake.Compression = opt.enableCompression && negotiatedCompression(request)
+		return m.HandleHandshake(gconn, handshake, keys)
 	}
-}
\ No newline at end of file
+}
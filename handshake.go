@@ -0,0 +1,88 @@
+package comet
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Handshake describes how a session was established, it is populated for
+// every transport so handlers can route on it uniformly.
+type Handshake struct {
+	Request     *http.Request // The original http request, nil for tcp sessions without a handshake frame.
+	Path        string        // Request path, empty for tcp sessions without a handshake frame.
+	Query       url.Values    // Request query values.
+	Header      http.Header   // Request headers.
+	RemoteAddr  net.Addr      // Network address of the peer.
+	LocalAddr   net.Addr      // Local network address.
+	Subprotocol string        // Negotiated subprotocol, if any.
+	Compression bool          // Whether the peer accepts compressed messages, set when a long-polling session upgrades.
+
+	TLS         *tls.ConnectionState // TLS state of the connection, nil for plain connections.
+	Credentials *Credentials         // Credentials of the peer process, nil unless connected over a unix socket.
+}
+
+// Credentials are the credentials of the process at the other end of a unix
+// socket, they are only available on linux.
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// netConner is implemented by the conns of transports running on a net.Conn.
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// NewHandshake returns the handshake of conn, r is the http request conn was
+// upgraded from or nil for connections that did not start as http requests.
+func NewHandshake(conn Conn, r *http.Request) *Handshake {
+	handshake := &Handshake{
+		Request:    r,
+		Query:      url.Values{},
+		Header:     http.Header{},
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+	}
+	if r != nil {
+		handshake.Path = r.URL.Path
+		handshake.Query = r.URL.Query()
+		handshake.Header = r.Header
+		handshake.TLS = r.TLS
+	}
+	if c, ok := conn.(netConner); ok {
+		handshake.peer(c.NetConn())
+	}
+	return handshake
+}
+
+// peer populates the TLS state and credentials of the peer of conn.
+func (handshake *Handshake) peer(conn net.Conn) {
+	switch conn := conn.(type) {
+	case *tls.Conn:
+		if handshake.TLS == nil {
+			handshake.TLS = tlsState(conn)
+		}
+	case *net.UnixConn:
+		handshake.Credentials, _ = peerCredentials(conn)
+	}
+}
+
+// tlsState returns the TLS state of conn, nil until its handshake completed.
+func tlsState(conn *tls.Conn) *tls.ConnectionState {
+	if state := conn.ConnectionState(); state.HandshakeComplete {
+		return &state
+	}
+	return nil
+}
+
+// context returns the context sessions established by the handshake derive from.
+func (handshake *Handshake) context() context.Context {
+	if handshake.Request != nil {
+		return handshake.Request.Context()
+	}
+	return context.Background()
+}
@@ -0,0 +1,245 @@
+package comet
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrUnknownStream is returned when a client posts to a stream that does not exist.
+var ErrUnknownStream = errors.New("comet: unknown stream")
+
+// errInterrupted is returned by reads interrupted before a message arrived.
+var errInterrupted = errors.New("comet: read interrupted")
+
+// httpAddr is the network address of the peer of an http request.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+type httpMessage struct {
+	t    int
+	data []byte
+}
+
+// httpConn is the client to server half of the plain http transports, the
+// client POSTs its messages which are queued until the session reads them.
+type httpConn struct {
+	request      *http.Request
+	token        string
+	incoming     chan httpMessage
+	done         chan struct{}
+	once         sync.Once
+	mutex        sync.Mutex
+	closed       bool
+	readLimit    int64
+	readDeadline time.Time
+	pongHandler  func(string) error
+	pingHandler  func(string) error
+	closeHandler func(int, string) error
+}
+
+func newHTTPConn(r *http.Request, buffer int) *httpConn {
+	return &httpConn{
+		request:  r,
+		token:    newSessionID(nil),
+		incoming: make(chan httpMessage, buffer),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *httpConn) LocalAddr() net.Addr {
+	addr, _ := c.request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func (c *httpConn) RemoteAddr() net.Addr {
+	return httpAddr(c.request.RemoteAddr)
+}
+
+func (c *httpConn) SetReadLimit(limit int64) {
+	c.mutex.Lock()
+	c.readLimit = limit
+	c.mutex.Unlock()
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	return nil
+}
+
+// ReadMessage returns the next message posted by the client, io.EOF once the
+// connection is closed or os.ErrDeadlineExceeded once the read deadline passed.
+func (c *httpConn) ReadMessage() (int, []byte, error) {
+	return c.readMessage(nil)
+}
+
+// readMessage is ReadMessage, it returns errInterrupted once interrupt is closed.
+func (c *httpConn) readMessage(interrupt <-chan struct{}) (int, []byte, error) {
+	for {
+		c.mutex.Lock()
+		deadline := c.readDeadline
+		c.mutex.Unlock()
+
+		if deadline.IsZero() {
+			select {
+			case msg := <-c.incoming:
+				return msg.t, msg.data, nil
+			case <-c.done:
+				return NoFrame, nil, io.EOF
+			case <-interrupt:
+				return NoFrame, nil, errInterrupted
+			}
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case msg := <-c.incoming:
+			timer.Stop()
+			return msg.t, msg.data, nil
+		case <-c.done:
+			timer.Stop()
+			return NoFrame, nil, io.EOF
+		case <-interrupt:
+			timer.Stop()
+			return NoFrame, nil, errInterrupted
+		case <-timer.C:
+		}
+
+		// the deadline may have been extended while waiting
+		c.mutex.Lock()
+		extended := c.readDeadline.After(deadline)
+		c.mutex.Unlock()
+		if !extended {
+			return NoFrame, nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *httpConn) SetPongHandler(fn func(string) error) {
+	c.mutex.Lock()
+	c.pongHandler = fn
+	c.mutex.Unlock()
+}
+
+func (c *httpConn) SetPingHandler(fn func(string) error) {
+	c.mutex.Lock()
+	c.pingHandler = fn
+	c.mutex.Unlock()
+}
+
+func (c *httpConn) SetCloseHandler(fn func(int, string) error) {
+	c.mutex.Lock()
+	c.closeHandler = fn
+	c.mutex.Unlock()
+}
+
+// pong runs the pong handler, the http transports answer pings themselves
+// once they reached the client.
+func (c *httpConn) pong(data []byte) {
+	c.mutex.Lock()
+	fn := c.pongHandler
+	c.mutex.Unlock()
+	if fn != nil {
+		_ = fn(string(data))
+	}
+}
+
+// Close ends the connection, pending and later reads return io.EOF.
+func (c *httpConn) Close() error {
+	c.once.Do(func() {
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+// stream returns the client to server half of the transports embedding httpConn.
+func (c *httpConn) stream() *httpConn {
+	return c
+}
+
+// httpStream is a connection of an http transport.
+type httpStream interface {
+	stream() *httpConn
+}
+
+// httpStreams indexes the connections of an http transport by token so the
+// requests of clients reach their connection.
+type httpStreams struct {
+	conns map[string]httpStream
+	mutex sync.RWMutex
+}
+
+func newHTTPStreams() *httpStreams {
+	return &httpStreams{conns: make(map[string]httpStream)}
+}
+
+func (streams *httpStreams) add(c httpStream) {
+	streams.mutex.Lock()
+	streams.conns[c.stream().token] = c
+	streams.mutex.Unlock()
+}
+
+func (streams *httpStreams) remove(c httpStream) {
+	streams.mutex.Lock()
+	delete(streams.conns, c.stream().token)
+	streams.mutex.Unlock()
+}
+
+func (streams *httpStreams) get(token string) httpStream {
+	streams.mutex.RLock()
+	defer streams.mutex.RUnlock()
+	return streams.conns[token]
+}
+
+// post queues the message posted in r on the connection named by the "session"
+// query parameter, application/octet-stream bodies are binary messages.
+// It returns the http status of the response and the error, if any.
+func (streams *httpStreams) post(w http.ResponseWriter, r *http.Request) (int, error) {
+	stream := streams.get(r.URL.Query().Get("session"))
+	if stream == nil {
+		return http.StatusNotFound, ErrUnknownStream
+	}
+	c := stream.stream()
+
+	c.mutex.Lock()
+	limit := c.readLimit
+	c.mutex.Unlock()
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		return http.StatusBadRequest, err
+	}
+
+	msg := httpMessage{t: TextMessage, data: data}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/octet-stream" {
+		msg.t = BinaryMessage
+	}
+
+	select {
+	case c.incoming <- msg:
+		return http.StatusNoContent, nil
+	case <-c.done:
+		return http.StatusGone, io.EOF
+	case <-r.Context().Done():
+		return http.StatusServiceUnavailable, r.Context().Err()
+	}
+}
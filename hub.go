@@ -1,22 +1,45 @@
 package comet
 
 import (
+	"context"
 	"errors"
 	"github.com/gorilla/websocket"
 	"sync"
 	"sync/atomic"
 )
 
+// ErrHubClosed is returned when broadcasting on a closed hub, and is the
+// context cause of the sessions closed by Hub.Close.
+var ErrHubClosed = errors.New("hub instance is Closed")
+
 type (
 	Hub struct {
-		sessions   map[*Session]bool
-		register   chan *Session
-		unregister chan *Session
-		exit       chan *envelope
-		buffers    []chan *envelope
-		open       bool
-		rwmutex    *sync.RWMutex
-		option     *hubOption
+		shards  []*hubShard
+		ids     *hubIndex
+		users   *hubIndex
+		buffers []chan *envelope
+		open    bool
+		rwmutex *sync.RWMutex
+		option  *hubOption
+	}
+
+	// hubShard holds the sessions, and their rooms, whose seq maps to it.
+	hubShard struct {
+		sessions map[*Session]bool
+		rooms    map[string]map[*Session]bool
+		joined   map[*Session]map[string]bool
+		users    map[*Session]string // the users sessions are bound to in this hub
+		rwmutex  sync.RWMutex
+	}
+
+	// hubIndex maps keys, like session IDs or users, to sessions, sharded by key.
+	hubIndex struct {
+		shards []*hubIndexShard
+	}
+
+	hubIndexShard struct {
+		sessions map[string]map[*Session]bool
+		rwmutex  sync.RWMutex
 	}
 
 	hubOption struct {
@@ -27,6 +50,31 @@ type (
 	}
 
 	HubOption func(*hubOption)
+
+	// Report describes the delivery of a broadcast to the sessions of a hub.
+	Report struct {
+		Matched int // sessions the filter accepted
+		Queued  int // sessions the message was queued for
+		Dropped int // sessions that dropped the message because their buffer was full
+		Closed  int // sessions that were closed
+
+		DroppedSessions []*Session
+		ClosedSessions  []*Session
+	}
+
+	// reporter collects the Report of a broadcast while it is fanned out.
+	reporter struct {
+		report Report
+		mutex  sync.Mutex
+		done   chan struct{}
+	}
+)
+
+const (
+	// hubShardSessions is the number of expected sessions per registry shard.
+	hubShardSessions = 64
+	// hubShardLimit is the maximum number of registry shards.
+	hubShardLimit = 256
 )
 
 func newHubOption() *hubOption {
@@ -38,6 +86,8 @@ func newHubOption() *hubOption {
 	}
 }
 
+// WithHubSession sets the expected number of sessions, the session registry
+// is split into one shard per 64 of them, up to 256 shards.
 func WithHubSession(size uint64) HubOption {
 	return func(option *hubOption) {
 		option.sessionSize = size
@@ -56,75 +106,235 @@ func WithHubBufferSize(size uint64) HubOption {
 	}
 }
 
+func newHubShard(size uint64) *hubShard {
+	return &hubShard{
+		sessions: make(map[*Session]bool, size),
+		rooms:    make(map[string]map[*Session]bool),
+		joined:   make(map[*Session]map[string]bool),
+		users:    make(map[*Session]string),
+	}
+}
+
 func NewHub(options ...HubOption) *Hub {
 	opt := newHubOption()
 	for _, option := range options {
 		option(opt)
 	}
+	count := uint64(1)
+	for count < opt.sessionSize/hubShardSessions && count < hubShardLimit {
+		count <<= 1
+	}
 	hub := &Hub{
-		sessions:   make(map[*Session]bool),
-		register:   make(chan *Session),
-		unregister: make(chan *Session),
-		exit:       make(chan *envelope),
-		buffers:    make([]chan *envelope, opt.bufferAmount),
-		open:       true,
-		rwmutex:    &sync.RWMutex{},
-		option:     opt,
+		shards:  make([]*hubShard, count),
+		ids:     newHubIndex(count),
+		users:   newHubIndex(count),
+		buffers: make([]chan *envelope, opt.bufferAmount),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+		option:  opt,
+	}
+	for i := range hub.shards {
+		hub.shards[i] = newHubShard(opt.sessionSize / count)
 	}
 	for i := uint64(0); i < opt.bufferAmount; i++ {
 		buffer := make(chan *envelope, opt.bufferSize)
 		hub.buffers[i] = buffer
 		go hub.proc(buffer)
 	}
-	go hub.run()
 	return hub
 }
 
+func newHubIndex(count uint64) *hubIndex {
+	index := &hubIndex{shards: make([]*hubIndexShard, count)}
+	for i := range index.shards {
+		index.shards[i] = &hubIndexShard{sessions: make(map[string]map[*Session]bool)}
+	}
+	return index
+}
+
+// shard returns the index shard of key, keys are hashed with FNV-1a.
+func (index *hubIndex) shard(key string) *hubIndexShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return index.shards[hash&uint32(len(index.shards)-1)]
+}
+
+func (index *hubIndex) add(key string, s *Session) {
+	shard := index.shard(key)
+	shard.rwmutex.Lock()
+	if _, ok := shard.sessions[key]; !ok {
+		shard.sessions[key] = make(map[*Session]bool)
+	}
+	shard.sessions[key][s] = true
+	shard.rwmutex.Unlock()
+}
+
+func (index *hubIndex) remove(key string, s *Session) {
+	shard := index.shard(key)
+	shard.rwmutex.Lock()
+	if sessions, ok := shard.sessions[key]; ok {
+		delete(sessions, s)
+		if len(sessions) == 0 {
+			delete(shard.sessions, key)
+		}
+	}
+	shard.rwmutex.Unlock()
+}
+
+func (index *hubIndex) get(key string) []*Session {
+	shard := index.shard(key)
+	shard.rwmutex.RLock()
+	sessions := make([]*Session, 0, len(shard.sessions[key]))
+	for s := range shard.sessions[key] {
+		sessions = append(sessions, s)
+	}
+	shard.rwmutex.RUnlock()
+	return sessions
+}
+
+func (index *hubIndex) clear() {
+	for _, shard := range index.shards {
+		shard.rwmutex.Lock()
+		shard.sessions = make(map[string]map[*Session]bool)
+		shard.rwmutex.Unlock()
+	}
+}
+
 func (h *Hub) proc(buffer chan *envelope) {
+	wg := &sync.WaitGroup{}
 	for {
 		m, ok := <-buffer
 		if !ok {
 			break
 		}
-		h.Range(func(s *Session) {
-			if m.filter != nil && !m.filter(s) {
-				return
+		// only the shards with members are written, in parallel when there is
+		// more than one of them. Messages are spread over the workers round-robin,
+		// so broadcasts may reach a session out of order.
+		var members [][]*Session
+		for _, shard := range h.shards {
+			if sessions := shard.snapshot(m.room); len(sessions) > 0 {
+				members = append(members, sessions)
 			}
-			s.writeMessage(m)
-		})
+		}
+		for i, sessions := range members {
+			if i == len(members)-1 {
+				h.deliver(m, sessions)
+				break
+			}
+			wg.Add(1)
+			go func(sessions []*Session) {
+				defer wg.Done()
+				h.deliver(m, sessions)
+			}(sessions)
+		}
+		wg.Wait()
+		if m.report != nil {
+			close(m.report.done)
+		}
 	}
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case s := <-h.register:
-			h.rwmutex.Lock()
-			h.sessions[s] = true
-			h.rwmutex.Unlock()
-		case s := <-h.unregister:
-			if _, ok := h.sessions[s]; ok {
-				h.rwmutex.Lock()
-				delete(h.sessions, s)
-				h.rwmutex.Unlock()
-			}
-		case m := <-h.exit:
-			h.Range(func(s *Session) {
-				s.writeMessage(m)
-			})
-
-			h.rwmutex.Lock()
-			h.sessions = map[*Session]bool{}
-			h.open = false
-			for _, buffer := range h.buffers {
-				close(buffer)
-			}
-			h.rwmutex.Unlock()
-			return
+func newReporter() *reporter {
+	return &reporter{done: make(chan struct{})}
+}
+
+// add records the result of writing the broadcast to session s.
+func (r *reporter) add(s *Session, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.report.Matched++
+	switch err {
+	case nil:
+		r.report.Queued++
+	case ErrBufferFull:
+		r.report.Dropped++
+		r.report.DroppedSessions = append(r.report.DroppedSessions, s)
+	default:
+		r.report.Closed++
+		r.report.ClosedSessions = append(r.report.ClosedSessions, s)
+	}
+}
+
+// snapshot returns a copy of the report collected so far.
+func (r *reporter) snapshot() Report {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	report := r.report
+	report.DroppedSessions = append([]*Session(nil), r.report.DroppedSessions...)
+	report.ClosedSessions = append([]*Session(nil), r.report.ClosedSessions...)
+	return report
+}
+
+// deliver writes m to the sessions its filter accepts.
+func (h *Hub) deliver(m *envelope, sessions []*Session) {
+	for _, s := range sessions {
+		if m.filter != nil && !m.filter(s) {
+			continue
+		}
+		err := s.writeMessage(m)
+		if m.report != nil {
+			m.report.add(s, err)
+		}
+	}
+}
+
+// shard returns the registry shard of session s.
+func (h *Hub) shard(s *Session) *hubShard {
+	return h.shards[s.seq&uint64(len(h.shards)-1)]
+}
+
+// snapshot copies the sessions of the shard, or of a room in the shard,
+// so they are written without holding the shard lock.
+func (shard *hubShard) snapshot(room string) []*Session {
+	shard.rwmutex.RLock()
+	defer shard.rwmutex.RUnlock()
+	members := shard.sessions
+	if room != "" {
+		members = shard.rooms[room]
+	}
+	sessions := make([]*Session, 0, len(members))
+	for s := range members {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// leave removes s from room and drops empty indexes, callers must hold the write lock.
+func (shard *hubShard) leave(s *Session, room string) {
+	if members, ok := shard.rooms[room]; ok {
+		delete(members, s)
+		if len(members) == 0 {
+			delete(shard.rooms, room)
+		}
+	}
+	if rooms, ok := shard.joined[s]; ok {
+		delete(rooms, room)
+		if len(rooms) == 0 {
+			delete(shard.joined, s)
 		}
 	}
 }
 
+// dispatch queues m on a broadcast worker, holding the read lock keeps
+// Close from closing the worker buffers meanwhile.
+func (h *Hub) dispatch(ctx context.Context, m *envelope) error {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	if !h.open {
+		return ErrHubClosed
+	}
+
+	select {
+	case h.buffers[h.buffer()] <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (h *Hub) buffer() uint64 {
 	return atomic.AddUint64(&h.option.bufferCount, 1) % h.option.bufferAmount
 }
@@ -134,7 +344,26 @@ func (h *Hub) Register(s *Session) {
 		return
 	}
 
-	h.register <- s
+	shard := h.shard(s)
+	shard.rwmutex.Lock()
+	h.register(shard, s)
+	shard.rwmutex.Unlock()
+}
+
+// register adds s to the registry and its indexes unless s is closed, so a
+// closed session is never registered again after its Unregister. Callers must
+// hold the write lock of the shard of s.
+func (h *Hub) register(shard *hubShard, s *Session) bool {
+	if s.closed() {
+		return false
+	}
+
+	shard.sessions[s] = true
+	h.ids.add(s.ID(), s)
+	if user, ok := shard.users[s]; ok {
+		h.users.add(user, s)
+	}
+	return true
 }
 
 func (h *Hub) Unregister(s *Session) {
@@ -142,7 +371,131 @@ func (h *Hub) Unregister(s *Session) {
 		return
 	}
 
-	h.unregister <- s
+	shard := h.shard(s)
+	shard.rwmutex.Lock()
+	delete(shard.sessions, s)
+	for room := range shard.joined[s] {
+		shard.leave(s, room)
+	}
+	h.ids.remove(s.ID(), s)
+	if user, ok := shard.users[s]; ok {
+		h.users.remove(user, s)
+		delete(shard.users, s)
+	}
+	shard.rwmutex.Unlock()
+}
+
+// Bind binds session s to user, registering s with the hub if it is not registered yet.
+// A user may have any number of sessions, e.g. one per browser tab or device.
+// Binding to an empty user unbinds s. Closed sessions are not bound. Bindings
+// are kept per hub, binding s in one hub does not change its binding in others.
+func (h *Hub) Bind(s *Session, user string) {
+	if h.Closed() {
+		return
+	}
+
+	// the shard lock serializes binds of s with each other and with Unregister.
+	shard := h.shard(s)
+	shard.rwmutex.Lock()
+	defer shard.rwmutex.Unlock()
+	if s.closed() {
+		return
+	}
+
+	if previous, ok := shard.users[s]; ok {
+		h.users.remove(previous, s)
+		delete(shard.users, s)
+	}
+	if user != "" {
+		shard.users[s] = user
+	}
+	s.user.Store(user)
+	h.register(shard, s)
+}
+
+// User returns the user session s is bound to in the hub, or an empty string.
+func (h *Hub) User(s *Session) string {
+	shard := h.shard(s)
+	shard.rwmutex.RLock()
+	user := shard.users[s]
+	shard.rwmutex.RUnlock()
+	return user
+}
+
+// Session returns the registered session with the given ID.
+func (h *Hub) Session(id string) (*Session, bool) {
+	sessions := h.ids.get(id)
+	if len(sessions) == 0 {
+		return nil, false
+	}
+	return sessions[0], true
+}
+
+// SessionsByUser returns the registered sessions bound to user.
+func (h *Hub) SessionsByUser(user string) []*Session {
+	return h.users.get(user)
+}
+
+// SendToUser writes a text message to all sessions bound to user, it returns
+// the first error but still writes to the remaining sessions.
+func (h *Hub) SendToUser(user string, msg []byte) error {
+	var err error
+	pm := NewPreparedMessage(websocket.TextMessage, msg)
+	for _, sess := range h.SessionsByUser(user) {
+		if writeErr := sess.WritePrepared(pm); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// Join adds session s to room, registering s with the hub if it is not registered yet.
+// A session may join any number of rooms and leaves all of them on Unregister.
+// Closed sessions do not join.
+func (h *Hub) Join(s *Session, room string) {
+	if h.Closed() {
+		return
+	}
+
+	shard := h.shard(s)
+	shard.rwmutex.Lock()
+	if !h.register(shard, s) {
+		shard.rwmutex.Unlock()
+		return
+	}
+	if _, ok := shard.rooms[room]; !ok {
+		shard.rooms[room] = make(map[*Session]bool)
+	}
+	shard.rooms[room][s] = true
+	if _, ok := shard.joined[s]; !ok {
+		shard.joined[s] = make(map[string]bool)
+	}
+	shard.joined[s][room] = true
+	shard.rwmutex.Unlock()
+}
+
+// Leave removes session s from room, s stays registered with the hub.
+func (h *Hub) Leave(s *Session, room string) {
+	if h.Closed() {
+		return
+	}
+
+	shard := h.shard(s)
+	shard.rwmutex.Lock()
+	shard.leave(s, room)
+	shard.rwmutex.Unlock()
+}
+
+// Rooms returns the rooms session s has joined.
+func (h *Hub) Rooms(s *Session) []string {
+	shard := h.shard(s)
+	shard.rwmutex.RLock()
+	rooms := make([]string, 0, len(shard.joined[s]))
+	for room := range shard.joined[s] {
+		rooms = append(rooms, room)
+	}
+	shard.rwmutex.RUnlock()
+	return rooms
 }
 
 // Closed returns the status of the hub instance.
@@ -155,32 +508,58 @@ func (h *Hub) Closed() bool {
 
 // Online return the number of connected sessions.
 func (h *Hub) Online() int {
-	h.rwmutex.RLock()
-	online := len(h.sessions)
-	h.rwmutex.RUnlock()
+	online := 0
+	for _, shard := range h.shards {
+		shard.rwmutex.RLock()
+		online += len(shard.sessions)
+		shard.rwmutex.RUnlock()
+	}
 	return online
 }
 
-// Broadcast broadcasts a text message to all sessions.
-func (h *Hub) Broadcast(msg []byte) error {
-	if h.Closed() {
-		return errors.New("hub instance is Closed")
+// RoomOnline return the number of sessions joined to room.
+func (h *Hub) RoomOnline(room string) int {
+	online := 0
+	for _, shard := range h.shards {
+		shard.rwmutex.RLock()
+		online += len(shard.rooms[room])
+		shard.rwmutex.RUnlock()
 	}
+	return online
+}
 
-	message := &envelope{t: websocket.TextMessage, msg: msg}
-	h.buffers[h.buffer()] <- message
-	return nil
+// Broadcast broadcasts a text message to all sessions.
+func (h *Hub) Broadcast(msg []byte) error {
+	message := prepare(websocket.TextMessage, msg)
+	return h.dispatch(context.Background(), message)
 }
 
 // BroadcastFilter broadcasts a text message to all sessions that fn returns true for.
 func (h *Hub) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
-	if h.Closed() {
-		return errors.New("hub instance is Closed")
+	message := prepare(websocket.TextMessage, msg)
+	message.filter = fn
+	return h.dispatch(context.Background(), message)
+}
+
+// BroadcastWithReport broadcasts a text message to all sessions that filter returns
+// true for, or all sessions if filter is nil, and waits until it is queued on every
+// one of them. The report tells how many sessions got the message queued and which
+// dropped it or were closed. If ctx is done first the partial report is returned
+// with the ctx error.
+func (h *Hub) BroadcastWithReport(ctx context.Context, msg []byte, filter func(*Session) bool) (Report, error) {
+	message := prepare(websocket.TextMessage, msg)
+	message.filter = filter
+	message.report = newReporter()
+	if err := h.dispatch(ctx, message); err != nil {
+		return Report{}, err
 	}
 
-	message := &envelope{t: websocket.TextMessage, msg: msg, filter: fn}
-	h.buffers[h.buffer()] <- message
-	return nil
+	select {
+	case <-message.report.done:
+		return message.report.snapshot(), nil
+	case <-ctx.Done():
+		return message.report.snapshot(), ctx.Err()
+	}
 }
 
 // BroadcastOthers broadcasts a text message to all sessions except session s.
@@ -192,34 +571,43 @@ func (h *Hub) BroadcastOthers(msg []byte, s *Session) error {
 
 // BroadcastMultiple broadcasts a text message to multiple sessions given in the sessions slice.
 func (h *Hub) BroadcastMultiple(msg []byte, sessions []*Session) error {
+	pm := NewPreparedMessage(websocket.TextMessage, msg)
 	for _, sess := range sessions {
-		if writeErr := sess.Write(msg); writeErr != nil {
+		if writeErr := sess.WritePrepared(pm); writeErr != nil {
 			return writeErr
 		}
 	}
 	return nil
 }
 
-// BroadcastBinary broadcasts a binary message to all sessions.
-func (h *Hub) BroadcastBinary(msg []byte) error {
-	if h.Closed() {
-		return errors.New("hub instance is Closed")
+// BroadcastRoom broadcasts a text message to all sessions joined to room.
+func (h *Hub) BroadcastRoom(room string, msg []byte) error {
+	message := prepare(websocket.TextMessage, msg)
+	message.room = room
+	return h.dispatch(context.Background(), message)
+}
+
+// BroadcastRoomOthers broadcasts a text message to all sessions joined to room except session s.
+func (h *Hub) BroadcastRoomOthers(room string, msg []byte, s *Session) error {
+	message := prepare(websocket.TextMessage, msg)
+	message.room = room
+	message.filter = func(q *Session) bool {
+		return s != q
 	}
+	return h.dispatch(context.Background(), message)
+}
 
-	message := &envelope{t: websocket.BinaryMessage, msg: msg}
-	h.buffers[h.buffer()] <- message
-	return nil
+// BroadcastBinary broadcasts a binary message to all sessions.
+func (h *Hub) BroadcastBinary(msg []byte) error {
+	message := prepare(websocket.BinaryMessage, msg)
+	return h.dispatch(context.Background(), message)
 }
 
 // BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
 func (h *Hub) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
-	if h.Closed() {
-		return errors.New("hub instance is Closed")
-	}
-
-	message := &envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	h.buffers[h.buffer()] <- message
-	return nil
+	message := prepare(websocket.BinaryMessage, msg)
+	message.filter = fn
+	return h.dispatch(context.Background(), message)
 }
 
 // BroadcastBinaryOthers broadcasts a binary message to all sessions except session s.
@@ -229,31 +617,77 @@ func (h *Hub) BroadcastBinaryOthers(msg []byte, s *Session) error {
 	})
 }
 
+// BroadcastRoomBinary broadcasts a binary message to all sessions joined to room.
+func (h *Hub) BroadcastRoomBinary(room string, msg []byte) error {
+	message := prepare(websocket.BinaryMessage, msg)
+	message.room = room
+	return h.dispatch(context.Background(), message)
+}
+
 // Close closes the hub instance and all connected sessions.
 func (h *Hub) Close() error {
-	if h.Closed() {
-		return errors.New("hub instance is already Closed")
-	}
-
-	h.exit <- &envelope{t: websocket.CloseMessage, msg: []byte{}}
-	return nil
+	return h.close([]byte{})
 }
 
 // CloseWithMsg closes the hub instance with the given close payload and all connected sessions.
 // Use the FormatCloseMessage function to format a proper close message payload.
 func (h *Hub) CloseWithMsg(msg []byte) error {
-	if h.Closed() {
+	return h.close(msg)
+}
+
+func (h *Hub) close(msg []byte) error {
+	h.rwmutex.Lock()
+	if !h.open {
+		h.rwmutex.Unlock()
 		return errors.New("hub instance is already Closed")
 	}
+	h.open = false
+	for _, buffer := range h.buffers {
+		close(buffer)
+	}
+	h.rwmutex.Unlock()
 
-	h.exit <- &envelope{t: websocket.CloseMessage, msg: msg}
+	for _, shard := range h.shards {
+		shard.rwmutex.Lock()
+		sessions := make([]*Session, 0, len(shard.sessions))
+		for s := range shard.sessions {
+			sessions = append(sessions, s)
+		}
+		shard.sessions = map[*Session]bool{}
+		shard.rooms = map[string]map[*Session]bool{}
+		shard.joined = map[*Session]map[string]bool{}
+		shard.users = map[*Session]string{}
+		shard.rwmutex.Unlock()
+
+		// close frames are sent without the shard lock and without waiting for slow sessions.
+		for _, s := range sessions {
+			s.closing(ErrHubClosed)
+			_ = s.writeClose(msg)
+		}
+	}
+	h.ids.clear()
+	h.users.clear()
 	return nil
 }
 
+// Range calls fn for every registered session, one shard at a time.
 func (h *Hub) Range(fn func(s *Session)) {
-	h.rwmutex.RLock()
-	for session := range h.sessions {
-		fn(session)
+	for _, shard := range h.shards {
+		shard.rwmutex.RLock()
+		for session := range shard.sessions {
+			fn(session)
+		}
+		shard.rwmutex.RUnlock()
+	}
+}
+
+// RangeRoom calls fn for every session joined to room.
+func (h *Hub) RangeRoom(room string, fn func(s *Session)) {
+	for _, shard := range h.shards {
+		shard.rwmutex.RLock()
+		for session := range shard.rooms[room] {
+			fn(session)
+		}
+		shard.rwmutex.RUnlock()
 	}
-	h.rwmutex.RUnlock()
 }
@@ -0,0 +1,238 @@
+// Package jsonrpc turns a comet instance into a JSON-RPC 2.0 endpoint.
+//
+// Example
+//
+//	m := comet.New()
+//	srv := jsonrpc.New(m)
+//	jsonrpc.Handle(srv, "add", func(s *comet.Session, params []int) (int, error) {
+//		return params[0] + params[1], nil
+//	})
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Tooooommy/comet"
+)
+
+// Version is the JSON-RPC protocol version.
+const Version = "2.0"
+
+// Standard error codes.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+)
+
+// Error is a JSON-RPC error object. Methods return an *Error to answer with a
+// specific code, any other error is answered with InternalError.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (%d)", e.Message, e.Code)
+}
+
+type (
+	request struct {
+		Version string
+		Method  string
+		Params  json.RawMessage
+		ID      *json.RawMessage // nil for notifications, null for a null id
+	}
+
+	response struct {
+		Version string           `json:"jsonrpc"`
+		Result  interface{}      `json:"result,omitempty"`
+		Error   *Error           `json:"error,omitempty"`
+		ID      *json.RawMessage `json:"id"`
+	}
+
+	notification struct {
+		Version string      `json:"jsonrpc"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params,omitempty"`
+	}
+
+	// methodFunc decodes params and runs a registered method.
+	methodFunc func(s *comet.Session, params json.RawMessage) (interface{}, error)
+)
+
+// Server routes the JSON-RPC requests received by the sessions of a comet instance.
+type Server struct {
+	methods map[string]methodFunc
+}
+
+// New returns a server handling the text messages of m, it replaces the
+// HandleMessage handler of m.
+func New(m *comet.Comet) *Server {
+	srv := &Server{methods: make(map[string]methodFunc)}
+	m.HandleMessage(srv.ServeMessage)
+	return srv
+}
+
+// Register registers fn as method name, fn must be a func(*comet.Session, T) (R, error).
+// The params of a request are decoded into a new T, by position if T is a slice
+// or array and by name if T is a struct or map.
+func (srv *Server) Register(name string, fn interface{}) {
+	method, err := comet.NewMethod(fn)
+	if err != nil {
+		panic(fmt.Sprintf("jsonrpc: method %q: %v", name, err))
+	}
+
+	srv.methods[name] = func(s *comet.Session, raw json.RawMessage) (interface{}, error) {
+		return method.Call(s, func(v interface{}) error {
+			return unmarshal(raw, v)
+		})
+	}
+}
+
+// Handle registers fn as method name of srv without reflection.
+func Handle[T, R any](srv *Server, name string, fn func(*comet.Session, T) (R, error)) {
+	srv.methods[name] = func(s *comet.Session, raw json.RawMessage) (interface{}, error) {
+		var params T
+		if err := unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return fn(s, params)
+	}
+}
+
+// unmarshal decodes raw params into v, missing params leave v unchanged.
+func unmarshal(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &Error{Code: InvalidParams, Message: "Invalid params", Data: err.Error()}
+	}
+	return nil
+}
+
+// Notify sends a notification of method with params to session s.
+func Notify(s *comet.Session, method string, params interface{}) error {
+	msg, err := json.Marshal(&notification{Version: Version, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	return s.Write(msg)
+}
+
+// ServeMessage answers the request, or batch of requests, in msg.
+func (srv *Server) ServeMessage(s *comet.Session, msg []byte) {
+	reply, err := srv.serve(s, msg)
+	if err != nil || reply == nil {
+		return
+	}
+	_ = s.Write(reply)
+}
+
+// serve returns the encoded reply to msg, or nil if msg only held notifications.
+func (srv *Server) serve(s *comet.Session, msg []byte) ([]byte, error) {
+	msg = bytes.TrimSpace(msg)
+	if !json.Valid(msg) {
+		return json.Marshal(failure(nil, &Error{Code: ParseError, Message: "Parse error"}))
+	}
+	if msg[0] != '[' {
+		if res := srv.call(s, decode(msg)); res != nil {
+			return json.Marshal(res)
+		}
+		return nil, nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(msg, &batch); err != nil || len(batch) == 0 {
+		return json.Marshal(failure(nil, &Error{Code: InvalidRequest, Message: "Invalid Request"}))
+	}
+
+	responses := make([]*response, 0, len(batch))
+	for _, raw := range batch {
+		if res := srv.call(s, decode(raw)); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(responses)
+}
+
+// decode decodes the request object raw field by field, so a field of the wrong
+// type makes the request invalid instead of failing the whole decoding. The id of
+// an invalid request is kept when it is a valid id.
+func decode(raw json.RawMessage) *request {
+	req := &request{}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return req
+	}
+	if id, ok := fields["id"]; ok {
+		if !validID(id) {
+			return req
+		}
+		req.ID = &id
+	}
+	if json.Unmarshal(fields["jsonrpc"], &req.Version) != nil || json.Unmarshal(fields["method"], &req.Method) != nil {
+		return &request{ID: req.ID}
+	}
+	req.Params = fields["params"]
+	return req
+}
+
+// validID reports whether id is a string, a number or null.
+func validID(id json.RawMessage) bool {
+	var v interface{}
+	if err := json.Unmarshal(id, &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// call runs a request, it returns nil for notifications.
+func (srv *Server) call(s *comet.Session, req *request) *response {
+	if req.Version != Version || req.Method == "" {
+		return failure(req.ID, &Error{Code: InvalidRequest, Message: "Invalid Request"})
+	}
+
+	method, ok := srv.methods[req.Method]
+	if !ok {
+		if req.ID == nil {
+			return nil
+		}
+		return failure(req.ID, &Error{Code: MethodNotFound, Message: "Method not found"})
+	}
+
+	result, err := method(s, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: InternalError, Message: err.Error()}
+		}
+		return failure(req.ID, rpcErr)
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return &response{Version: Version, Result: result, ID: req.ID}
+}
+
+func failure(id *json.RawMessage, err *Error) *response {
+	return &response{Version: Version, Error: err, ID: id}
+}
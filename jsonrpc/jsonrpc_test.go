@@ -0,0 +1,124 @@
+package jsonrpc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tooooommy/comet"
+	"github.com/gorilla/websocket"
+)
+
+type pair struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func NewTestServer(t *testing.T) (*websocket.Conn, chan *comet.Session) {
+	m := comet.New()
+	srv := New(m)
+	srv.Register("add", func(s *comet.Session, params []int) (int, error) {
+		sum := 0
+		for _, n := range params {
+			sum += n
+		}
+		return sum, nil
+	})
+	Handle(srv, "sub", func(s *comet.Session, params pair) (int, error) {
+		return params.A - params.B, nil
+	})
+	Handle(srv, "fail", func(s *comet.Session, params struct{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	Handle(srv, "teapot", func(s *comet.Session, params struct{}) (interface{}, error) {
+		return nil, &Error{Code: 418, Message: "I'm a teapot"}
+	})
+
+	sessions := make(chan *comet.Session, 1)
+	m.HandleConnect(func(s *comet.Session) {
+		sessions <- s
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = comet.HandleGws(m)(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, sessions
+}
+
+func TestServer(t *testing.T) {
+	conn, _ := NewTestServer(t)
+
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"positional", `{"jsonrpc":"2.0","method":"add","params":[1,2,3],"id":1}`, `{"jsonrpc":"2.0","result":6,"id":1}`},
+		{"named", `{"jsonrpc":"2.0","method":"sub","params":{"a":5,"b":3},"id":"a"}`, `{"jsonrpc":"2.0","result":2,"id":"a"}`},
+		{"zero result", `{"jsonrpc":"2.0","method":"add","id":2}`, `{"jsonrpc":"2.0","result":0,"id":2}`},
+		{"error", `{"jsonrpc":"2.0","method":"fail","id":3}`, `{"jsonrpc":"2.0","error":{"code":-32603,"message":"failed"},"id":3}`},
+		{"custom error", `{"jsonrpc":"2.0","method":"teapot","id":4}`, `{"jsonrpc":"2.0","error":{"code":418,"message":"I'm a teapot"},"id":4}`},
+		{"method not found", `{"jsonrpc":"2.0","method":"mul","id":5}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":5}`},
+		{"invalid params", `{"jsonrpc":"2.0","method":"add","params":{"a":1},"id":6}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":"json: cannot unmarshal object into Go value of type []int"},"id":6}`},
+		{"invalid request", `{"jsonrpc":"1.0","method":"add","id":7}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":7}`},
+		{"invalid method", `{"jsonrpc":"2.0","method":1,"id":8}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":8}`},
+		{"invalid id", `{"jsonrpc":"2.0","method":"add","id":{}}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"null id", `{"jsonrpc":"2.0","method":"add","params":[1],"id":null}`, `{"jsonrpc":"2.0","result":1,"id":null}`},
+		{"parse error", `{"jsonrpc":"2.0","method"`, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"empty batch", `[]`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"batch", `[{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1},{"jsonrpc":"2.0","method":"add","params":[1]},1,{"jsonrpc":"2.0","method":"sub","params":{"a":1},"id":2}]`,
+			`[{"jsonrpc":"2.0","result":3,"id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},{"jsonrpc":"2.0","result":1,"id":2}]`},
+	}
+
+	for _, test := range tests {
+		conn.WriteMessage(websocket.TextMessage, []byte(test.msg))
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != test.want {
+			t.Errorf("%s: reply should equal %s, got %s", test.name, test.want, ret)
+		}
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	conn, sessions := NewTestServer(t)
+
+	// notifications, even of failing or unknown methods, are not answered
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"fail"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc":"2.0","method":"mul"},{"jsonrpc":"2.0","method":"add","params":[1]}]`))
+
+	s := <-sessions
+	if err := Notify(s, "update", []int{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, ret, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"jsonrpc":"2.0","method":"update","params":[1]}`; string(ret) != want {
+		t.Errorf("notification should equal %s, got %s", want, ret)
+	}
+}
+
+func TestRegisterSignature(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a method with the wrong signature should panic")
+		}
+	}()
+	New(comet.New()).Register("invalid", func(params int) int { return params })
+}
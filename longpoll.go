@@ -0,0 +1,577 @@
+package comet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Long-polling transport.
+//
+// A client opens a session with a GET request answered with {"session": token}.
+// It then polls with GET requests carrying the token in the "session" query
+// parameter, each poll is held until messages are queued for the client or the
+// poll wait elapsed and answers a JSON array of {"seq", "type", "data"} messages.
+// The type is "text", "binary" with base64 encoded data or "close" whose data is
+// the close code followed by the close text. Polls acknowledge the messages
+// received so far with the "ack" query parameter set to the last seq, messages
+// that were not acknowledged are answered again so a lost poll response loses
+// nothing, polls without ack acknowledge every message. Client messages are
+// POSTed like with HandleSse and a DELETE request closes the session.
+//
+// The session stays connected as long as the client polls at least once per
+// Conf.PongWait, it then disconnects like a websocket session whose pongs
+// stopped. Sessions served with WithLongPollLifetime are closed with
+// CloseGoingAway once their lifetime elapsed, clients then open a new one.
+
+// ErrSessionExpired is the context cause of the sessions closed once their
+// WithLongPollLifetime elapsed.
+var ErrSessionExpired = errors.New("comet: session expired")
+
+type (
+	longPollOption struct {
+		wait       time.Duration
+		lifetime   time.Duration
+		bufferSize int
+		errorResponse
+	}
+
+	LongPollOption func(*longPollOption)
+)
+
+func newLongPollOption() *longPollOption {
+	return &longPollOption{
+		wait:       25 * time.Second,
+		bufferSize: 16,
+	}
+}
+
+// WithLongPollWait sets how long polls are held waiting for messages, it is
+// capped to half of Conf.PongWait so held polls keep the session alive.
+func WithLongPollWait(wait time.Duration) LongPollOption {
+	return func(option *longPollOption) {
+		option.wait = wait
+	}
+}
+
+// WithLongPollLifetime sets the maximum lifetime of a session, however often it
+// is polled. Zero, the default, never expires sessions.
+func WithLongPollLifetime(lifetime time.Duration) LongPollOption {
+	return func(option *longPollOption) {
+		option.lifetime = lifetime
+	}
+}
+
+// WithLongPollBufferSize sets the number of messages queued per session in each
+// direction before writes and posts wait for the peer to poll or read them.
+func WithLongPollBufferSize(size int) LongPollOption {
+	return func(option *longPollOption) {
+		option.bufferSize = size
+	}
+}
+
+// WithLongPollErrorResponse sets the function writing the http error response
+// when a request is rejected.
+func WithLongPollErrorResponse(fn func(w http.ResponseWriter, r *http.Request, status int, reason error)) LongPollOption {
+	return func(option *longPollOption) {
+		option.errorResponse = fn
+	}
+}
+
+// polledMessage is a message answered to a poll.
+type polledMessage struct {
+	Seq  uint64 `json:"seq"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// queuedMessage is a message queued for the polls, it keeps the frame written
+// to the session so it can be written again once upgraded.
+type queuedMessage struct {
+	polledMessage
+	t    int
+	data []byte
+}
+
+// long-polling conn, it can be upgraded to a websocket conn during the session.
+type pConn struct {
+	*httpConn
+	outgoing      chan *queuedMessage
+	polled        chan struct{}
+	upgrading     chan struct{} // closed once an upgrade started
+	switched      chan struct{} // closed once the upgrade ended
+	polling       sync.Mutex
+	writing       sync.Mutex
+	writeDeadline time.Time
+	ws            Conn                   // guarded by mutex, set once upgraded
+	onUpgrade     func(compression bool) // called once upgraded with the negotiated compression
+	seq           uint64
+	pending       []*queuedMessage // answered but not acknowledged, guarded by polling
+}
+
+func newPConn(r *http.Request, buffer int) *pConn {
+	return &pConn{
+		httpConn:  newHTTPConn(r, buffer),
+		outgoing:  make(chan *queuedMessage, buffer),
+		polled:    make(chan struct{}, 1),
+		upgrading: make(chan struct{}),
+		switched:  make(chan struct{}),
+	}
+}
+
+// upgraded returns the conn the session was upgraded to, if any.
+func (c *pConn) upgraded() Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ws
+}
+
+// EnableWriteCompression enables compression of the messages written to the
+// websocket conn the session was upgraded to, polled messages are not compressed.
+func (c *pConn) EnableWriteCompression(enable bool) {
+	if ws, ok := c.upgraded().(Compressor); ok {
+		ws.EnableWriteCompression(enable)
+	}
+}
+
+// SetCompressionLevel sets the compression level of the websocket conn the
+// session was upgraded to.
+func (c *pConn) SetCompressionLevel(level int) error {
+	if ws, ok := c.upgraded().(Compressor); ok {
+		return ws.SetCompressionLevel(level)
+	}
+	return nil
+}
+
+func (c *pConn) SetReadLimit(limit int64) {
+	c.httpConn.SetReadLimit(limit)
+	if ws := c.upgraded(); ws != nil {
+		ws.SetReadLimit(limit)
+	}
+}
+
+func (c *pConn) SetReadDeadline(t time.Time) error {
+	_ = c.httpConn.SetReadDeadline(t)
+	if ws := c.upgraded(); ws != nil {
+		return ws.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *pConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeDeadline = t
+	ws := c.ws
+	c.mutex.Unlock()
+	if ws != nil {
+		return ws.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (c *pConn) SetPongHandler(fn func(string) error) {
+	c.httpConn.SetPongHandler(fn)
+	if ws := c.upgraded(); ws != nil {
+		ws.SetPongHandler(fn)
+	}
+}
+
+func (c *pConn) SetPingHandler(fn func(string) error) {
+	c.httpConn.SetPingHandler(fn)
+	if ws := c.upgraded(); ws != nil {
+		ws.SetPingHandler(fn)
+	}
+}
+
+func (c *pConn) SetCloseHandler(fn func(int, string) error) {
+	c.httpConn.SetCloseHandler(fn)
+	if ws := c.upgraded(); ws != nil {
+		ws.SetCloseHandler(fn)
+	}
+}
+
+// ReadMessage returns the messages posted by the client, once upgraded the ones
+// posted before the upgrade and then the ones read from the websocket conn.
+func (c *pConn) ReadMessage() (int, []byte, error) {
+	for {
+		if ws := c.upgraded(); ws != nil {
+			select {
+			case msg := <-c.incoming:
+				return msg.t, msg.data, nil
+			default:
+			}
+			return ws.ReadMessage()
+		}
+
+		t, data, err := c.readMessage(c.switched)
+		if err != errInterrupted {
+			return t, data, err
+		}
+	}
+}
+
+// WriteMessage queues a message for the next poll, it waits for room in the
+// queue until the write deadline. Pings and pongs are not sent, polls keep the
+// session alive instead. Once upgraded messages are written to the websocket conn,
+// writes interrupted by the upgrade wait until the queued messages were written to it.
+func (c *pConn) WriteMessage(_type int, data []byte) error {
+	for {
+		c.writing.Lock()
+		if ws := c.upgraded(); ws != nil {
+			err := ws.WriteMessage(_type, data)
+			c.writing.Unlock()
+			return err
+		}
+		err := c.queueMessage(_type, data)
+		c.writing.Unlock()
+		if err != errInterrupted {
+			return err
+		}
+		<-c.switched
+	}
+}
+
+// queueMessage queues a message for the next poll, callers must hold writing.
+func (c *pConn) queueMessage(_type int, data []byte) error {
+	msg := &queuedMessage{t: _type, data: append([]byte(nil), data...)}
+	switch _type {
+	case TextMessage:
+		msg.Type, msg.Data = "text", string(data)
+	case BinaryMessage:
+		msg.Type, msg.Data = "binary", base64.StdEncoding.EncodeToString(data)
+	case CloseMessage:
+		code, text := CloseNoStatusReceived, ""
+		if len(data) >= 2 {
+			code, text = int(binary.BigEndian.Uint16(data)), string(data[2:])
+		}
+		msg.Type, msg.Data = "close", strings.TrimSpace(fmt.Sprintf("%d %s", code, text))
+	case PingMessage, PongMessage:
+		return nil
+	default:
+		return fmt.Errorf("unknown message type: %d", _type)
+	}
+
+	c.mutex.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mutex.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.outgoing <- msg:
+		return nil
+	case <-c.done:
+		return io.ErrClosedPipe
+	case <-c.upgrading:
+		return errInterrupted
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// upgrade hands the conn over to ws. The messages not acknowledged by query and
+// the ones still queued are written to ws first, so no message is lost, and ws
+// is only used by the session once they were written, so none is reordered.
+func (c *pConn) upgrade(ws Conn, query url.Values, compression bool) error {
+	c.mutex.Lock()
+	select {
+	case <-c.upgrading:
+		c.mutex.Unlock()
+		return ErrUnknownStream
+	default:
+	}
+	if c.closed {
+		c.mutex.Unlock()
+		return ErrUnknownStream
+	}
+	// wake up the pending poll and the write waiting for room in the queue
+	close(c.upgrading)
+	_ = ws.SetWriteDeadline(c.writeDeadline)
+	c.mutex.Unlock()
+	defer close(c.switched)
+
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	c.polling.Lock()
+	defer c.polling.Unlock()
+
+	c.acknowledge(query)
+	for len(c.outgoing) > 0 {
+		c.queue(<-c.outgoing)
+	}
+	pending := c.pending
+	c.pending = nil
+	for _, msg := range pending {
+		if err := ws.WriteMessage(msg.t, msg.data); err != nil {
+			_ = c.httpConn.Close()
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ErrUnknownStream
+	}
+	c.ws = ws
+	ws.SetReadLimit(c.readLimit)
+	_ = ws.SetReadDeadline(c.readDeadline)
+	_ = ws.SetWriteDeadline(c.writeDeadline)
+	ws.SetPongHandler(c.pongHandler)
+	ws.SetPingHandler(c.pingHandler)
+	ws.SetCloseHandler(c.closeHandler)
+	c.mutex.Unlock()
+
+	if c.onUpgrade != nil {
+		c.onUpgrade(compression)
+	}
+	return nil
+}
+
+// Close ends the connection and the websocket conn it was upgraded to.
+func (c *pConn) Close() error {
+	_ = c.httpConn.Close()
+	if ws := c.upgraded(); ws != nil {
+		return ws.Close()
+	}
+	return nil
+}
+
+// poll answers the messages not acknowledged by r, or waits up to wait for
+// messages to be queued. The messages queued before the conn closed are still
+// answered, afterwards and once upgrading polls are answered with http.StatusGone.
+// Answering a close message closes the conn.
+func (c *pConn) poll(w http.ResponseWriter, r *http.Request, wait time.Duration) (int, error) {
+	c.polling.Lock()
+	defer c.polling.Unlock()
+	defer c.signal()
+
+	select {
+	case <-c.upgrading:
+		return http.StatusGone, io.EOF
+	default:
+	}
+
+	c.pong(nil)
+	defer c.pong(nil)
+
+	c.acknowledge(r.URL.Query())
+
+	if len(c.pending) == 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case msg := <-c.outgoing:
+			c.queue(msg)
+		case <-c.done:
+		case <-c.upgrading:
+			timer.Stop()
+			return http.StatusGone, io.EOF
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return http.StatusServiceUnavailable, r.Context().Err()
+		}
+		timer.Stop()
+	}
+	c.drain()
+
+	if len(c.pending) == 0 {
+		select {
+		case <-c.done:
+			return http.StatusGone, io.EOF
+		default:
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	messages := c.pending
+	if messages == nil {
+		messages = []*queuedMessage{}
+	}
+	err := json.NewEncoder(w).Encode(messages)
+
+	// clients can not answer the close message, the session ends once it is polled
+	for _, msg := range messages {
+		if msg.Type == "close" {
+			_ = c.Close()
+		}
+	}
+	return http.StatusOK, err
+}
+
+// acknowledge drops the pending messages acknowledged by query, callers must hold polling.
+func (c *pConn) acknowledge(query url.Values) {
+	acks, ok := query["ack"]
+	if !ok || len(acks) == 0 {
+		c.pending = nil
+		return
+	}
+	ack, err := strconv.ParseUint(acks[0], 10, 64)
+	if err != nil {
+		return
+	}
+	i := 0
+	for i < len(c.pending) && c.pending[i].Seq <= ack {
+		i++
+	}
+	c.pending = c.pending[i:]
+}
+
+// queue numbers msg and adds it to the pending messages, callers must hold polling.
+func (c *pConn) queue(msg *queuedMessage) {
+	c.seq++
+	msg.Seq = c.seq
+	c.pending = append(c.pending, msg)
+}
+
+// drain moves the queued messages to the pending ones without waiting, callers must hold polling.
+func (c *pConn) drain() {
+	for len(c.pending) < cap(c.outgoing) {
+		select {
+		case msg := <-c.outgoing:
+			c.queue(msg)
+		default:
+			return
+		}
+	}
+}
+
+// signal wakes up linger after a poll.
+func (c *pConn) signal() {
+	select {
+	case c.polled <- struct{}{}:
+	default:
+	}
+}
+
+// linger waits until the messages queued before the session ended are polled,
+// or timeout elapsed.
+func (c *pConn) linger(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(c.outgoing) > 0 {
+		select {
+		case <-c.polled:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// HandleLongPoll serves sessions over http long-polling, for clients that can
+// neither upgrade to websockets nor read event streams. GET requests without a
+// session token open a session, GET requests with one poll its messages, POST
+// requests send the messages of the client and DELETE requests close it, all on
+// the url the handler is mounted on.
+//
+// Sessions outlive the request opening them, their context is not cancelled
+// with it and Session.Request is a copy of it without its context.
+func HandleLongPoll(m *Comet, options ...LongPollOption) HandlerFunc {
+	opt := newLongPollOption()
+	for _, option := range options {
+		option(opt)
+	}
+	return serveLongPoll(m, opt, newHTTPStreams())
+}
+
+// serveLongPoll serves long-polling sessions registered in streams, which may
+// be shared with other http transports.
+func serveLongPoll(m *Comet, opt *longPollOption, streams *httpStreams) HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		token := request.URL.Query().Get("session")
+		var conn *pConn
+		if token != "" {
+			if stream, ok := streams.get(token).(*pConn); ok {
+				conn = stream
+			}
+		}
+
+		switch {
+		case request.Method == http.MethodPost:
+			status, err := streams.post(writer, request)
+			if err != nil {
+				opt.reject(writer, request, status, err)
+				return err
+			}
+			writer.WriteHeader(status)
+			return nil
+		case request.Method == http.MethodDelete || request.Method == http.MethodGet && token != "":
+			if conn == nil {
+				opt.reject(writer, request, http.StatusNotFound, ErrUnknownStream)
+				return ErrUnknownStream
+			}
+			if request.Method == http.MethodDelete {
+				_ = conn.Close()
+				writer.WriteHeader(http.StatusNoContent)
+				return nil
+			}
+			wait := opt.wait
+			if pongWait := m.Config.PongWait; pongWait > 0 && wait > pongWait/2 {
+				wait = pongWait / 2
+			}
+			status, err := conn.poll(writer, request, wait)
+			if err != nil && status != http.StatusOK {
+				opt.reject(writer, request, status, err)
+			}
+			return err
+		case request.Method == http.MethodGet:
+		default:
+			err := fmt.Errorf("method %s not allowed", request.Method)
+			writer.Header().Set("Allow", "GET, POST, DELETE")
+			opt.reject(writer, request, http.StatusMethodNotAllowed, err)
+			return err
+		}
+
+		if m.sessions.closed() {
+			opt.reject(writer, request, http.StatusServiceUnavailable, ErrServerClosed)
+			return ErrServerClosed
+		}
+
+		authenticated, status, err := m.authenticate(request)
+		if err != nil {
+			opt.reject(writer, request, status, err)
+			return err
+		}
+
+		conn = newPConn(request, opt.bufferSize)
+		handshake := NewHandshake(conn, request.WithContext(context.Background()))
+		session := m.newSession(handshake.context(), conn, handshake, requestKeys(request, authenticated))
+		conn.onUpgrade = session.upgraded
+		streams.add(conn)
+		go func() {
+			if opt.lifetime > 0 {
+				expire := time.AfterFunc(opt.lifetime, func() {
+					session.closing(ErrSessionExpired)
+					_ = session.CloseWithMsg(FormatCloseMessage(CloseGoingAway, ErrSessionExpired.Error()))
+				})
+				defer expire.Stop()
+			}
+			_ = m.handle(session)
+			conn.linger(m.Config.PongWait)
+			streams.remove(conn)
+		}()
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-cache")
+		return json.NewEncoder(writer).Encode(map[string]string{"session": conn.token})
+	}
+}
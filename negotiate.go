@@ -0,0 +1,174 @@
+package comet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports served by HandleNegotiate, in order of preference.
+const (
+	TransportWebsocket = "websocket"
+	TransportSse       = "sse"
+	TransportLongPoll  = "longpoll"
+)
+
+// ErrUnknownTransport is returned when a client asks for a transport that is
+// not served.
+var ErrUnknownTransport = errors.New("comet: unknown transport")
+
+type (
+	negotiateOption struct {
+		transports []string
+		gws        []GwsOption
+		sse        []SseOption
+		longPoll   []LongPollOption
+	}
+
+	NegotiateOption func(*negotiateOption)
+)
+
+func newNegotiateOption() *negotiateOption {
+	return &negotiateOption{
+		transports: []string{TransportWebsocket, TransportSse, TransportLongPoll},
+	}
+}
+
+// WithNegotiateTransports sets the transports offered to clients, in order of
+// preference. All of them are offered by default.
+func WithNegotiateTransports(transports ...string) NegotiateOption {
+	return func(option *negotiateOption) {
+		option.transports = transports
+	}
+}
+
+// WithNegotiateGws sets the options of websocket sessions and upgrades.
+func WithNegotiateGws(options ...GwsOption) NegotiateOption {
+	return func(option *negotiateOption) {
+		option.gws = options
+	}
+}
+
+// WithNegotiateSse sets the options of Server-Sent Events sessions.
+func WithNegotiateSse(options ...SseOption) NegotiateOption {
+	return func(option *negotiateOption) {
+		option.sse = options
+	}
+}
+
+// WithNegotiateLongPoll sets the options of long-polling sessions.
+func WithNegotiateLongPoll(options ...LongPollOption) NegotiateOption {
+	return func(option *negotiateOption) {
+		option.longPoll = options
+	}
+}
+
+// offers reports whether transport is offered to clients.
+func (option *negotiateOption) offers(transport string) bool {
+	for _, offered := range option.transports {
+		if offered == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleNegotiate serves every transport on one url so clients can fall back
+// from websockets to Server-Sent Events to long-polling.
+//
+// A plain GET request answers {"transports": [...]}, the offered transports in
+// order of preference. Websocket upgrade requests open websocket sessions and
+// the "transport" query parameter selects the "sse" or "longpoll" transport,
+// whose requests are then served as by HandleSse and HandleLongPoll. Requests
+// carrying a session token without a transport are long-polling requests.
+//
+// A long-polling session is upgraded to a websocket by a websocket upgrade
+// request carrying its token in the "session" query parameter and the last
+// message received by the client in "ack". The messages the client did not
+// receive yet are written to the websocket before any other, polls are then
+// answered with http.StatusGone and the client must stop posting messages.
+func HandleNegotiate(m *Comet, options ...NegotiateOption) HandlerFunc {
+	opt := newNegotiateOption()
+	for _, option := range options {
+		option(opt)
+	}
+
+	gwsOpt := newGwsOption()
+	for _, option := range opt.gws {
+		option(gwsOpt)
+	}
+	sseOpt := newSseOption()
+	for _, option := range opt.sse {
+		option(sseOpt)
+	}
+	longPollOpt := newLongPollOption()
+	for _, option := range opt.longPoll {
+		option(longPollOpt)
+	}
+
+	upgrader := gwsOpt.upgrader()
+	streams := newHTTPStreams()
+	gws := HandleGws(m, opt.gws...)
+	sse := serveSse(m, sseOpt, streams)
+	longPoll := serveLongPoll(m, longPollOpt, streams)
+
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		query := request.URL.Query()
+		transport, token := query.Get("transport"), query.Get("session")
+		if websocket.IsWebSocketUpgrade(request) {
+			transport = TransportWebsocket
+		}
+
+		if transport == "" && token == "" {
+			if request.Method != http.MethodGet {
+				err := fmt.Errorf("method %s not allowed", request.Method)
+				writer.Header().Set("Allow", http.MethodGet)
+				gwsOpt.reject(writer, request, http.StatusMethodNotAllowed, err)
+				return err
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			writer.Header().Set("Cache-Control", "no-cache")
+			return json.NewEncoder(writer).Encode(map[string][]string{"transports": opt.transports})
+		}
+
+		if transport == "" {
+			transport = TransportLongPoll
+		}
+		if !opt.offers(transport) {
+			gwsOpt.reject(writer, request, http.StatusBadRequest, ErrUnknownTransport)
+			return ErrUnknownTransport
+		}
+
+		switch transport {
+		case TransportWebsocket:
+			if token == "" {
+				return gws(writer, request)
+			}
+			conn, ok := streams.get(token).(*pConn)
+			if !ok {
+				gwsOpt.reject(writer, request, http.StatusNotFound, ErrUnknownStream)
+				return ErrUnknownStream
+			}
+			ws, err := upgrader.Upgrade(writer, request, writer.Header())
+			if err != nil {
+				return err
+			}
+			compression := gwsOpt.enableCompression && negotiatedCompression(request)
+			if err := conn.upgrade(NewGConn(ws), query, compression); err != nil {
+				_ = ws.Close()
+				return err
+			}
+			return nil
+		case TransportSse:
+			return sse(writer, request)
+		case TransportLongPoll:
+			return longPoll(writer, request)
+		default:
+			gwsOpt.reject(writer, request, http.StatusBadRequest, ErrUnknownTransport)
+			return ErrUnknownTransport
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package comet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrServerClosed is returned by Comet.Handle and TCPServer.Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("comet: server closed")
+
+// ShutdownError is returned when sessions did not finish before the shutdown deadline,
+// those sessions are closed without waiting for their pending messages.
+type ShutdownError struct {
+	Sessions []*Session
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("%d sessions did not finish before the shutdown deadline", len(e.Sessions))
+}
+
+// registry tracks running sessions so they can be drained on shutdown.
+type registry struct {
+	sessions map[*Session]struct{}
+	done     chan struct{} // closed when the last session of a shutting down registry finished
+	closing  bool
+	mutex    sync.Mutex
+}
+
+func newRegistry() *registry {
+	return &registry{
+		sessions: make(map[*Session]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// add tracks session, it returns false once shutdown began.
+func (r *registry) add(session *Session) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closing {
+		return false
+	}
+	r.sessions[session] = struct{}{}
+	return true
+}
+
+func (r *registry) remove(session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, session)
+	if r.closing && len(r.sessions) == 0 {
+		close(r.done)
+	}
+}
+
+func (r *registry) list() []*Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (r *registry) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sessions)
+}
+
+func (r *registry) closed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closing
+}
+
+// shutdown rejects new sessions, sends msg as a close frame to every session
+// and waits until they finished. If ctx is done first, the remaining sessions
+// are closed and reported in a *ShutdownError.
+func (r *registry) shutdown(ctx context.Context, msg []byte) error {
+	if !r.close() {
+		return ErrServerClosed
+	}
+	return r.drain(ctx, msg)
+}
+
+// close rejects new sessions, it returns false if the registry was already closed.
+func (r *registry) close() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closing {
+		return false
+	}
+	r.closing = true
+	if len(r.sessions) == 0 {
+		close(r.done)
+	}
+	return true
+}
+
+// drain sends msg as a close frame to every session of a closed registry
+// and waits until they finished or ctx is done.
+func (r *registry) drain(ctx context.Context, msg []byte) error {
+	for _, session := range r.list() {
+		session.closing(ErrServerClosed)
+		_ = session.CloseWithMsg(msg)
+	}
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	remaining := r.list()
+	for _, session := range remaining {
+		session.close()
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	return &ShutdownError{Sessions: remaining}
+}
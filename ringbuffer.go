@@ -18,7 +18,6 @@ package comet
 
 import (
 	"errors"
-	"runtime"
 	"sync/atomic"
 	"time"
 )
@@ -58,9 +57,10 @@ type nodes []node
 
 // RingBuffer is a MPMC buffer that achieves threadsafety with CAS operations
 // only.  A put on full or get on empty call will block until an item
-// is put or retrieved.  Calling Dispose on the RingBuffer will unblock
-// any blocked threads with an error.  This buffer is similar to the buffer
-// described here: http://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue
+// is put or retrieved.  Blocked callers are parked on a channel instead of
+// spinning, so an idle buffer costs no cpu.  Calling Dispose on the RingBuffer
+// will unblock any blocked threads with an error.  This buffer is similar to
+// the buffer described here: http://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue
 // with some minor additions.
 type RingBuffer struct {
 	_padding0      [8]uint64
@@ -71,26 +71,74 @@ type RingBuffer struct {
 	mask, disposed uint64
 	_padding3      [8]uint64
 	nodes          nodes
+	readable       chan struct{} // signaled after a put, wakes one parked getter
+	writable       chan struct{} // signaled after a get, wakes one parked putter
+	done           chan struct{} // closed by Dispose, wakes everyone
 }
 
 func (rb *RingBuffer) init(size uint64) {
+	// a single slot can't tell a full queue from an empty one.
+	if size < 2 {
+		size = 2
+	}
 	size = roundUp(size)
 	rb.nodes = make(nodes, size)
 	for i := uint64(0); i < size; i++ {
 		rb.nodes[i] = node{position: i}
 	}
 	rb.mask = size - 1 // so we don't have to do this with every put/get operation
+	rb.readable = make(chan struct{}, 1)
+	rb.writable = make(chan struct{}, 1)
+	rb.done = make(chan struct{})
+}
+
+// signal wakes up one waiter parked on ch, it never blocks.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait parks the caller until ch is signaled, the queue is disposed or
+// the timer fires. A nil timer waits without a deadline.
+func (rb *RingBuffer) wait(ch chan struct{}, timer *time.Timer) error {
+	var expired <-chan time.Time
+	if timer != nil {
+		expired = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-rb.done:
+		return ErrDisposed
+	case <-expired:
+		return ErrTimeout
+	}
 }
 
 // Put adds the provided item to the queue.  If the queue is full, this
-// call will block until an item is added to the queue or Dispose is called
-// on the queue.  An error will be returned if the queue is disposed.
-func (rb *RingBuffer) Put(item *envelope) error {
-	_, err := rb.put(item)
+// call will block until an item is retrieved from the queue, Dispose is called
+// on the queue or the optional timeout is reached.  An error will be returned
+// if the queue is disposed or a timeout occurs.
+func (rb *RingBuffer) Put(item *envelope, timeouts ...time.Duration) error {
+	var timer *time.Timer
+	if len(timeouts) > 0 && timeouts[0] > 0 {
+		timer = time.NewTimer(timeouts[0])
+		defer timer.Stop()
+	}
+	_, err := rb.put(item, timer, false)
 	return err
 }
 
-func (rb *RingBuffer) put(item *envelope) (bool, error) {
+// Offer adds the provided item to the queue if there is space.  If the queue
+// is full, this call will return false.  An error will be returned if the
+// queue is disposed.
+func (rb *RingBuffer) Offer(item *envelope) (bool, error) {
+	return rb.put(item, nil, true)
+}
+
+func (rb *RingBuffer) put(item *envelope, timer *time.Timer, offer bool) (bool, error) {
 	var n *node
 	pos := atomic.LoadUint64(&rb.queue)
 L:
@@ -101,23 +149,31 @@ L:
 
 		n = &rb.nodes[pos&rb.mask]
 		seq := atomic.LoadUint64(&n.position)
-		switch dif := seq - pos; {
+		switch dif := int64(seq - pos); {
 		case dif == 0:
 			if atomic.CompareAndSwapUint64(&rb.queue, pos, pos+1) {
 				break L
 			}
 		case dif < 0:
-			// panic(`Ring buffer in a compromised state during a put operation.`)
-			return false, ErrPanic
+			if offer {
+				return false, nil
+			}
+			// the queue is full, park until a get frees a slot.
+			if err := rb.wait(rb.writable, timer); err != nil {
+				return false, err
+			}
+			pos = atomic.LoadUint64(&rb.queue)
 		default:
 			pos = atomic.LoadUint64(&rb.queue)
 		}
-
-		runtime.Gosched() // free up the cpu before the next iteration
 	}
 
 	n.data = item
 	atomic.StoreUint64(&n.position, pos+1)
+	signal(rb.readable)
+	if rb.Len() < rb.Cap() {
+		signal(rb.writable)
+	}
 	return true, nil
 }
 
@@ -139,14 +195,26 @@ func (rb *RingBuffer) Get(timeouts ...time.Duration) (*envelope, error) {
 // error will be returned if the queue is disposed or a timeout occurs. A
 // non-positive timeout will block indefinitely.
 func (rb *RingBuffer) Poll(timeout time.Duration) (*envelope, error) {
-	var (
-		n     *node
-		pos   = atomic.LoadUint64(&rb.dequeue)
-		start time.Time
-	)
+	var timer *time.Timer
 	if timeout > 0 {
-		start = time.Now()
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
 	}
+	return rb.get(timer, false)
+}
+
+// Shift removes and returns the next item in the queue without blocking.
+// A nil item is returned if the queue is empty.  An error will be returned
+// if the queue is disposed.
+func (rb *RingBuffer) Shift() (*envelope, error) {
+	return rb.get(nil, true)
+}
+
+func (rb *RingBuffer) get(timer *time.Timer, offer bool) (*envelope, error) {
+	var (
+		n   *node
+		pos = atomic.LoadUint64(&rb.dequeue)
+	)
 L:
 	for {
 		if atomic.LoadUint64(&rb.disposed) == 1 {
@@ -155,27 +223,31 @@ L:
 
 		n = &rb.nodes[pos&rb.mask]
 		seq := atomic.LoadUint64(&n.position)
-		switch dif := seq - (pos + 1); {
+		switch dif := int64(seq - (pos + 1)); {
 		case dif == 0:
 			if atomic.CompareAndSwapUint64(&rb.dequeue, pos, pos+1) {
 				break L
 			}
 		case dif < 0:
-			// panic(`Ring buffer in compromised state during a get operation.`)
-			return nil, ErrPanic
+			if offer {
+				return nil, nil
+			}
+			// the queue is empty, park until a put, a dispose or the timeout.
+			if err := rb.wait(rb.readable, timer); err != nil {
+				return nil, err
+			}
+			pos = atomic.LoadUint64(&rb.dequeue)
 		default:
 			pos = atomic.LoadUint64(&rb.dequeue)
 		}
-
-		if timeout > 0 && time.Since(start) >= timeout {
-			return nil, ErrTimeout
-		}
-
-		runtime.Gosched() // free up the cpu before the next iteration
 	}
 	data := n.data
 	n.data = nil
 	atomic.StoreUint64(&n.position, pos+rb.mask+1)
+	signal(rb.writable)
+	if rb.Len() > 0 {
+		signal(rb.readable)
+	}
 	return data, nil
 }
 
@@ -193,7 +265,9 @@ func (rb *RingBuffer) Cap() uint64 {
 // in the Put and/or Get methods.  Calling those methods on a disposed
 // queue will return an error.
 func (rb *RingBuffer) Dispose() {
-	atomic.CompareAndSwapUint64(&rb.disposed, 0, 1)
+	if atomic.CompareAndSwapUint64(&rb.disposed, 0, 1) {
+		close(rb.done)
+	}
 }
 
 // IsDisposed will return a bool indicating if this queue has been
@@ -0,0 +1,217 @@
+package comet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// CallEvent is the event of a call, its data is {"id": 1, "method": "confirm", "params": ...}.
+	CallEvent = "rpc.call"
+
+	// ResultEvent is the event answering a call, its data is {"id": 1, "result": ...}
+	// or {"id": 1, "error": "..."}.
+	ResultEvent = "rpc.result"
+)
+
+// ErrUnknownMethod is replied to calls of methods without a handler.
+var ErrUnknownMethod = errors.New("comet: unknown method")
+
+// CallError is returned by Session.Call when the peer answered with an error.
+type CallError struct {
+	Method  string
+	Message string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call %s: %s", e.Method, e.Message)
+}
+
+// rpcRequest is the data of a CallEvent, params and results are JSON encoded
+// whatever the EventCodec of the envelope is.
+type rpcRequest struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcResponse is the data of a ResultEvent.
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Method is a func(*Session, T) (R, error) handler, like the ones answering
+// calls registered with Comet.OnCall.
+type Method struct {
+	fn     reflect.Value
+	params reflect.Type
+}
+
+// NewMethod returns fn as a Method, it fails if fn is not a func(*Session, T) (R, error).
+func NewMethod(fn interface{}) (*Method, error) {
+	v, err := handlerFunc(fn, nil, errorType)
+	if err != nil {
+		return nil, fmt.Errorf("method must be a func(*Session, T) (R, error), %v", err)
+	}
+	return &Method{fn: v, params: v.Type().In(1)}, nil
+}
+
+// Call decodes the params of a call into a new T with unmarshal and calls the
+// method with session s, it returns the result R or the error of the method.
+func (method *Method) Call(s *Session, unmarshal func(v interface{}) error) (interface{}, error) {
+	params := reflect.New(method.params)
+	if err := unmarshal(params.Interface()); err != nil {
+		return nil, err
+	}
+
+	out := method.fn.Call([]reflect.Value{reflect.ValueOf(s), params.Elem()})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	return out[0].Interface(), nil
+}
+
+// OnCall answers the calls of method made by clients with fn, which must be a
+// func(*Session, T) (R, error). The call params are decoded into a new T and the
+// result R, or the error, is sent back as a ResultEvent with the call ID.
+func (m *Comet) OnCall(method string, fn interface{}) {
+	handler, err := NewMethod(fn)
+	if err != nil {
+		panic(fmt.Sprintf("comet: handler of method %q: %v", method, err))
+	}
+
+	if m.calls == nil {
+		m.calls = make(map[string]*Method)
+	}
+	m.calls[method] = handler
+}
+
+// answer runs the handler of a call made by the client of session s and replies its result.
+func (m *Comet) answer(s *Session, data []byte) {
+	var request rpcRequest
+	if err := m.Config.EventCodec.Unmarshal(data, &request); err != nil {
+		m.eventErrorHandler(s, CallEvent, err)
+		return
+	}
+
+	response := &rpcResponse{ID: request.ID}
+	result, err := m.call(s, &request)
+	if err == nil {
+		response.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if err := s.Emit(ResultEvent, response); err != nil {
+		m.handleError(s, err)
+	}
+}
+
+func (m *Comet) call(s *Session, request *rpcRequest) (interface{}, error) {
+	handler, ok := m.calls[request.Method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+
+	return handler.Call(s, func(v interface{}) error {
+		if len(request.Params) == 0 {
+			return nil
+		}
+		return json.Unmarshal(request.Params, v)
+	})
+}
+
+// resolve hands the answer to a call made with Session.Call to the waiting caller.
+func (s *Session) resolve(data []byte) {
+	var response rpcResponse
+	if err := s.comet.Config.EventCodec.Unmarshal(data, &response); err != nil {
+		s.comet.eventErrorHandler(s, ResultEvent, err)
+		return
+	}
+
+	s.rwmutex.Lock()
+	pending, ok := s.calls[response.ID]
+	delete(s.calls, response.ID)
+	s.rwmutex.Unlock()
+	if ok {
+		pending <- &response
+	}
+}
+
+// pending returns the number of calls waiting for an answer.
+func (s *Session) pending() int {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+	return len(s.calls)
+}
+
+// Call calls method on the client of the session with params and waits for its
+// JSON encoded result, or until ctx is done, Conf.CallTimeout elapsed or the
+// session closed. An error answered by the client is returned as a *CallError.
+//
+// Answers are read by the read pump of the session, so Call must not be used
+// from the message or event handlers of the same session, nor from connect
+// handlers, which run before the read pump starts. Call from a goroutine
+// started by the handler instead, e.g. to probe clients on connect.
+func (s *Session) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout := s.comet.Config.CallTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	answer := make(chan *rpcResponse, 1)
+	s.rwmutex.Lock()
+	if !s.open {
+		s.rwmutex.Unlock()
+		return nil, ErrSessionClosed
+	}
+	s.callSeq++
+	id := s.callSeq
+	if s.calls == nil {
+		s.calls = make(map[uint64]chan *rpcResponse)
+	}
+	s.calls[id] = answer
+	s.rwmutex.Unlock()
+
+	defer func() {
+		s.rwmutex.Lock()
+		delete(s.calls, id)
+		s.rwmutex.Unlock()
+	}()
+
+	if err := s.Emit(CallEvent, &rpcRequest{ID: id, Method: method, Params: data}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-answer:
+		if response == nil {
+			return nil, ErrSessionClosed
+		}
+		if response.Error != "" {
+			return nil, &CallError{Method: method, Message: response.Error}
+		}
+		return response.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// failCalls answers the pending calls of a closing session, callers must hold the write lock.
+func (s *Session) failCalls() {
+	for id, pending := range s.calls {
+		close(pending)
+		delete(s.calls, id)
+	}
+}
@@ -1,41 +1,214 @@
 package comet
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"github.com/labstack/gommon/log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrBufferFull is reported to the error handler and returned by writes when a
+// message is dropped or a session is disconnected because its message buffer is full.
+var ErrBufferFull = errors.New("session message buffer is full")
+
+// ErrSessionClosed is returned when writing to a closed session.
+var ErrSessionClosed = errors.New("session is Closed")
+
+// sessionSeq numbers sessions so the hub can spread them over its shards.
+var sessionSeq uint64
+
+// newSessionID returns a random 128 bit hex encoded session ID.
+func newSessionID(*Handshake) string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
 // Session wrapper around websocket connections.
 type Session struct {
-	req     *http.Request
-	keys    map[string]interface{}
-	conn    Conn
-	buffer  *RingBuffer
-	comet   *Comet
-	open    bool
-	rwmutex *sync.RWMutex
+	seq       uint64
+	id        string
+	user      atomic.Value
+	handshake *Handshake
+	keys      map[string]interface{}
+	kmutex    sync.RWMutex
+	conn      Conn
+	buffer    *RingBuffer
+	comet     *Comet
+	open      bool
+	rwmutex   *sync.RWMutex
+	coalesced map[string]*envelope
+	closeMsg  []byte
+	flushed   chan struct{}
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	reason    error // why the session is closing, the cause of ctx
+	calls     map[uint64]chan *rpcResponse
+	callSeq   uint64
 }
 
-func (s *Session) writeMessage(message *envelope) {
+// writeMessage queues message, it returns ErrBufferFull if the message was
+// dropped by the slow consumer policy and ErrSessionClosed if s is closed.
+func (s *Session) writeMessage(message *envelope) error {
 	if s.closed() {
-		s.comet.errorHandler(s, errors.New("tried to write to Closed a session"))
-		return
+		s.comet.handleError(s, errors.New("tried to write to Closed a session"))
+		return ErrSessionClosed
 	}
-	if err := s.buffer.Put(message); err != nil {
-		s.comet.errorHandler(s, errors.New("session message buffer is full"))
+
+	conf := s.comet.Config
+	switch conf.SlowConsumer {
+	case SlowConsumerDropOldest:
+		for {
+			ok, err := s.buffer.Offer(message)
+			if err != nil {
+				return ErrSessionClosed
+			}
+			if ok {
+				return nil
+			}
+			dropped, err := s.buffer.Shift()
+			if err != nil {
+				return ErrSessionClosed
+			}
+			if dropped != nil && dropped.t == CloseMessage {
+				// never drop a close frame, messages queued after it are not sent anyway.
+				s.disconnect(dropped.msg)
+				return ErrSessionClosed
+			}
+			if dropped != nil {
+				s.comet.handleError(s, ErrBufferFull)
+			}
+		}
+	case SlowConsumerBlock:
+		switch err := s.buffer.Put(message, conf.SlowConsumerWait); err {
+		case nil:
+			return nil
+		case ErrTimeout:
+			s.comet.handleError(s, ErrBufferFull)
+			return ErrBufferFull
+		default:
+			return ErrSessionClosed
+		}
+	case SlowConsumerDisconnect:
+		err := s.offer(message)
+		if err == ErrBufferFull {
+			s.closing(ErrBufferFull)
+			s.disconnect(FormatCloseMessage(conf.SlowConsumerCode, ErrBufferFull.Error()))
+		}
+		return err
+	case SlowConsumerCoalesce:
+		return s.coalesce(message, conf.CoalesceKey(message.msg))
+	default:
+		return s.offer(message)
 	}
 }
 
+// offer queues message without waiting for room in the buffer.
+func (s *Session) offer(message *envelope) error {
+	ok, err := s.buffer.Offer(message)
+	if err != nil {
+		return ErrSessionClosed
+	}
+	if !ok {
+		s.comet.handleError(s, ErrBufferFull)
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// coalesce replaces the payload of a queued message with the same key,
+// or queues a copy of message that later writes with that key can replace.
+func (s *Session) coalesce(message *envelope, key string) error {
+	if key == "" || message.t == CloseMessage {
+		return s.offer(message)
+	}
+
+	s.rwmutex.Lock()
+	if queued, ok := s.coalesced[key]; ok {
+		queued.t = message.t
+		queued.msg = message.msg
+		queued.compress = message.compress
+		queued.prepared = message.prepared
+		s.rwmutex.Unlock()
+		return nil
+	}
+	if s.coalesced == nil {
+		s.coalesced = make(map[string]*envelope)
+	}
+	queued := &envelope{t: message.t, msg: message.msg, key: key, compress: message.compress, prepared: message.prepared}
+	s.coalesced[key] = queued
+	s.rwmutex.Unlock()
+
+	err := s.offer(queued)
+	if err != nil {
+		s.rwmutex.Lock()
+		delete(s.coalesced, key)
+		s.rwmutex.Unlock()
+	}
+	return err
+}
+
+// dequeued detaches a coalesced message from later writes and returns
+// a snapshot of it that is safe to write.
+func (s *Session) dequeued(message *envelope) *envelope {
+	if message.key == "" {
+		return message
+	}
+
+	s.rwmutex.Lock()
+	delete(s.coalesced, message.key)
+	snapshot := &envelope{t: message.t, msg: message.msg, compress: message.compress, prepared: message.prepared}
+	s.rwmutex.Unlock()
+	return snapshot
+}
+
+// disconnect makes the write pump send msg as a close frame, skipping
+// any queued messages, and close the connection.
+func (s *Session) disconnect(msg []byte) {
+	s.rwmutex.Lock()
+	if s.open && s.closeMsg == nil {
+		s.closeMsg = msg
+		s.buffer.Dispose()
+	}
+	s.rwmutex.Unlock()
+}
+
+// writeClose queues a close frame with msg regardless of Conf.SlowConsumer,
+// it disconnects the session without waiting if the message buffer is full.
+func (s *Session) writeClose(msg []byte) error {
+	ok, err := s.buffer.Offer(&envelope{t: CloseMessage, msg: msg})
+	if err != nil {
+		return ErrSessionClosed
+	}
+	if !ok {
+		s.disconnect(msg)
+	}
+	return nil
+}
+
 func (s *Session) writeRaw(message *envelope) error {
 	if s.closed() {
 		return errors.New("tried to write to a Closed session")
 	}
 
+	if compressor, ok := s.conn.(Compressor); ok && s.compression() {
+		compressor.EnableWriteCompression(message.compress || len(message.msg) >= s.comet.Config.CompressThreshold)
+	}
+
 	s.conn.SetWriteDeadline(time.Now().Add(s.comet.Config.WriteWait))
-	err := s.conn.WriteMessage(message.t, message.msg)
+	var err error
+	if preparer, ok := s.conn.(Preparer); ok && message.prepared != nil {
+		err = preparer.WritePreparedMessage(message.prepared)
+	} else {
+		err = s.conn.WriteMessage(message.t, message.msg)
+	}
 
 	if err != nil {
 		log.Error("WriteRaw")
@@ -45,6 +218,25 @@ func (s *Session) writeRaw(message *envelope) error {
 	return nil
 }
 
+// compression reports whether the peer accepts compressed messages.
+func (s *Session) compression() bool {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+	return s.handshake.Compression
+}
+
+// upgraded records the compression negotiated when a long-polling session
+// upgraded to a websocket.
+func (s *Session) upgraded(compression bool) {
+	s.rwmutex.Lock()
+	s.handshake.Compression = compression
+	s.rwmutex.Unlock()
+
+	if compressor, ok := s.conn.(Compressor); ok && compression {
+		_ = compressor.SetCompressionLevel(s.comet.Config.CompressLevel)
+	}
+}
+
 func (s *Session) closed() bool {
 	s.rwmutex.RLock()
 	closed := !s.open
@@ -52,10 +244,33 @@ func (s *Session) closed() bool {
 	return closed
 }
 
+// closing records why the session is being closed, the first reason wins
+// and becomes the cause of the session context.
+func (s *Session) closing(reason error) {
+	s.rwmutex.Lock()
+	if s.reason == nil {
+		s.reason = reason
+	}
+	s.rwmutex.Unlock()
+}
+
+// end cancels the session context with the recorded reason, or err if there is none.
+func (s *Session) end(err error) {
+	s.rwmutex.RLock()
+	reason := s.reason
+	s.rwmutex.RUnlock()
+	if reason == nil {
+		reason = err
+	}
+	s.cancel(reason)
+}
+
 func (s *Session) close() {
+	s.end(ErrSessionClosed)
 	if !s.closed() {
 		s.rwmutex.Lock()
 		s.open = false
+		s.failCalls()
 		s.buffer.Dispose()
 		_ = s.conn.Close()
 		s.rwmutex.Unlock()
@@ -67,11 +282,17 @@ func (s *Session) ping() {
 }
 
 func (s *Session) writePump() {
-	ticker := time.NewTicker(s.comet.Config.PingPeriod)
-	defer ticker.Stop()
+	defer close(s.flushed)
 	for {
 		msg, err := s.buffer.Get(s.comet.Config.PingPeriod)
 		if err == ErrDisposed || err == ErrPanic {
+			s.rwmutex.RLock()
+			closeMsg := s.closeMsg
+			s.rwmutex.RUnlock()
+			if closeMsg != nil {
+				_ = s.writeRaw(&envelope{t: CloseMessage, msg: closeMsg})
+				_ = s.conn.Close()
+			}
 			break
 		}
 		if err == ErrTimeout {
@@ -79,10 +300,11 @@ func (s *Session) writePump() {
 			continue
 		}
 
+		msg = s.dequeued(msg)
 		err = s.writeRaw(msg)
 
 		if err != nil {
-			s.comet.errorHandler(s, err)
+			s.comet.handleError(s, err)
 			break
 		}
 
@@ -120,51 +342,79 @@ func (s *Session) readPump() {
 		t, message, err := s.conn.ReadMessage()
 
 		if err != nil {
-			s.comet.errorHandler(s, err)
+			s.end(err)
+			s.comet.handleError(s, err)
 			break
 		}
 
 		if t == TextMessage {
-			s.comet.messageHandler(s, message)
+			s.comet.textHandler(s, message)
 		}
 
 		if t == BinaryMessage {
-			s.comet.messageHandlerBinary(s, message)
+			s.comet.binaryHandler(s, message)
 		}
 	}
 }
 
-// Write writes message to session.
+// Write writes message to session, it returns ErrBufferFull if the message was
+// dropped by Conf.SlowConsumer and ErrSessionClosed if the session is closed.
 func (s *Session) Write(msg []byte) error {
 	if s.closed() {
-		return errors.New("session is Closed")
+		return ErrSessionClosed
 	}
 
-	s.writeMessage(&envelope{t: TextMessage, msg: msg})
-
-	return nil
+	return s.writeMessage(&envelope{t: TextMessage, msg: msg})
 }
 
 // WriteBinary writes a binary message to session.
 func (s *Session) WriteBinary(msg []byte) error {
 	if s.closed() {
-		return errors.New("session is Closed")
+		return ErrSessionClosed
 	}
 
-	s.writeMessage(&envelope{t: BinaryMessage, msg: msg})
+	return s.writeMessage(&envelope{t: BinaryMessage, msg: msg})
+}
 
-	return nil
+// WriteCompressed writes a text message to session, compressing it regardless
+// of Conf.CompressThreshold if the session supports compression.
+func (s *Session) WriteCompressed(msg []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeMessage(&envelope{t: TextMessage, msg: msg, compress: true})
 }
 
-// Close closes session.
+// WriteBinaryCompressed writes a binary message to session, compressing it
+// regardless of Conf.CompressThreshold if the session supports compression.
+func (s *Session) WriteBinaryCompressed(msg []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeMessage(&envelope{t: BinaryMessage, msg: msg, compress: true})
+}
+
+// WritePrepared writes a prepared message to session, use it to send the
+// same message to many sessions.
+func (s *Session) WritePrepared(pm *PreparedMessage) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeMessage(&envelope{t: pm.t, msg: pm.msg, prepared: pm})
+}
+
+// Close closes session, the close frame is sent after the queued messages or
+// instead of them if the message buffer is full.
 func (s *Session) Close() error {
 	if s.closed() {
 		return errors.New("session is already Closed")
 	}
 
-	s.writeMessage(&envelope{t: CloseMessage, msg: []byte{}})
-
-	return nil
+	s.closing(ErrSessionClosed)
+	return s.writeClose([]byte{})
 }
 
 // CloseWithMsg closes the session with the provided payload.
@@ -174,32 +424,63 @@ func (s *Session) CloseWithMsg(msg []byte) error {
 		return errors.New("session is already Closed")
 	}
 
-	s.writeMessage(&envelope{t: CloseMessage, msg: msg})
-
-	return nil
+	s.closing(ErrSessionClosed)
+	return s.writeClose(msg)
 }
 
-// Request is http original Request.
+// Request is http original Request, it is nil for sessions that did not start as http requests.
 func (s *Session) Request() *http.Request {
-	return s.req
+	return s.handshake.Request
+}
+
+// Handshake returns how the session was established.
+func (s *Session) Handshake() *Handshake {
+	return s.handshake
+}
+
+// Context returns the context of the session, derived from the request or
+// Comet.HandleContext context. It is cancelled when the connection can no longer
+// be read or the session is closed, context.Cause tells why: the read error, the
+// close error of a received close frame, ErrBufferFull for disconnected slow
+// consumers, ErrServerClosed on shutdown, ErrHubClosed when its hub closed,
+// ErrSessionExpired when its long-polling lifetime elapsed or ErrSessionClosed
+// when it was closed by the application.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// ID returns the unique ID of the session, see Conf.SessionID.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// User returns the user the session was last bound to with Hub.Bind, or an
+// empty string, use Hub.User for its binding in a given hub.
+func (s *Session) User() string {
+	user, _ := s.user.Load().(string)
+	return user
 }
 
 // Set is used to store a new key/value pair exclusivelly for this session.
 // It also lazy initializes s.keys if it was not used previously.
 func (s *Session) Set(key string, value interface{}) {
+	s.kmutex.Lock()
 	if s.keys == nil {
 		s.keys = make(map[string]interface{})
 	}
 
 	s.keys[key] = value
+	s.kmutex.Unlock()
 }
 
 // Get returns the value for the given key, ie: (value, true).
 // If the value does not exists it returns (nil, false)
 func (s *Session) Get(key string) (value interface{}, exists bool) {
+	s.kmutex.RLock()
 	if s.keys != nil {
 		value, exists = s.keys[key]
 	}
+	s.kmutex.RUnlock()
 
 	return
 }
@@ -213,6 +494,88 @@ func (s *Session) MustGet(key string) interface{} {
 	panic("Key \"" + key + "\" does not exist")
 }
 
+// Delete removes the value for the given key.
+func (s *Session) Delete(key string) {
+	s.kmutex.Lock()
+	delete(s.keys, key)
+	s.kmutex.Unlock()
+}
+
+// Keys returns a copy of the key/value pairs of the session.
+func (s *Session) Keys() map[string]interface{} {
+	s.kmutex.RLock()
+	keys := make(map[string]interface{}, len(s.keys))
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	s.kmutex.RUnlock()
+	return keys
+}
+
+// GetString returns the value for the given key as a string,
+// or "" if it does not exist or is not a string.
+func (s *Session) GetString(key string) string {
+	value, _ := Value[string](s, key)
+	return value
+}
+
+// GetBool returns the value for the given key as a bool,
+// or false if it does not exist or is not a bool.
+func (s *Session) GetBool(key string) bool {
+	value, _ := Value[bool](s, key)
+	return value
+}
+
+// GetInt returns the value for the given key as an int,
+// or 0 if it does not exist or is not an int.
+func (s *Session) GetInt(key string) int {
+	value, _ := Value[int](s, key)
+	return value
+}
+
+// GetInt64 returns the value for the given key as an int64,
+// or 0 if it does not exist or is not an int64.
+func (s *Session) GetInt64(key string) int64 {
+	value, _ := Value[int64](s, key)
+	return value
+}
+
+// GetFloat64 returns the value for the given key as a float64,
+// or 0 if it does not exist or is not a float64.
+func (s *Session) GetFloat64(key string) float64 {
+	value, _ := Value[float64](s, key)
+	return value
+}
+
+// GetTime returns the value for the given key as a time.Time,
+// or the zero time if it does not exist or is not a time.Time.
+func (s *Session) GetTime(key string) time.Time {
+	value, _ := Value[time.Time](s, key)
+	return value
+}
+
+// GetDuration returns the value for the given key as a time.Duration,
+// or 0 if it does not exist or is not a time.Duration.
+func (s *Session) GetDuration(key string) time.Duration {
+	value, _ := Value[time.Duration](s, key)
+	return value
+}
+
+// GetStringSlice returns the value for the given key as a []string,
+// or nil if it does not exist or is not a []string.
+func (s *Session) GetStringSlice(key string) []string {
+	value, _ := Value[[]string](s, key)
+	return value
+}
+
+// Value returns the value for the given key of session s as a T, ie: (value, true).
+// If the value does not exist or is not a T it returns (zero value, false).
+func Value[T any](s *Session, key string) (T, bool) {
+	value, _ := s.Get(key)
+	typed, ok := value.(T)
+	return typed, ok
+}
+
 // IsClosed returns the status of the connection.
 func (s *Session) IsClosed() bool {
 	return s.closed()
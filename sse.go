@@ -0,0 +1,219 @@
+package comet
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-Sent Events transport.
+//
+// A client opens the event stream with a GET request, the first event of the
+// stream is an "open" event whose data is the stream token. The client sends
+// messages by POSTing them to the same url with the token in the "session"
+// query parameter, binary messages with the application/octet-stream content
+// type. Text messages are sent as unnamed events, binary messages as base64
+// encoded "binary" events, close messages as "close" events whose data is the
+// close code followed by the close text, and pings as comments. Carriage
+// returns of text messages are sent as line feeds.
+
+type (
+	sseOption struct {
+		retry      time.Duration
+		bufferSize int
+		errorResponse
+	}
+
+	SseOption func(*sseOption)
+)
+
+func newSseOption() *sseOption {
+	return &sseOption{
+		bufferSize: 16,
+	}
+}
+
+// WithSseRetry sets the delay after which browsers reconnect a lost event stream.
+func WithSseRetry(retry time.Duration) SseOption {
+	return func(option *sseOption) {
+		option.retry = retry
+	}
+}
+
+// WithSseBufferSize sets the number of posted messages queued per session
+// before further posts wait for the session to read them.
+func WithSseBufferSize(size int) SseOption {
+	return func(option *sseOption) {
+		option.bufferSize = size
+	}
+}
+
+// WithSseErrorResponse sets the function writing the http error response
+// when a request is rejected.
+func WithSseErrorResponse(fn func(w http.ResponseWriter, r *http.Request, status int, reason error)) SseOption {
+	return func(option *sseOption) {
+		option.errorResponse = fn
+	}
+}
+
+// server-sent events conn
+type sConn struct {
+	*httpConn
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	writing    sync.Mutex // serializes writes to the stream, slow clients do not hold mutex
+}
+
+func (c *sConn) SetWriteDeadline(t time.Time) error {
+	return c.controller.SetWriteDeadline(t)
+}
+
+func (c *sConn) WriteMessage(_type int, data []byte) error {
+	c.writing.Lock()
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed {
+		c.writing.Unlock()
+		return io.ErrClosedPipe
+	}
+	var err error
+	switch _type {
+	case TextMessage:
+		err = c.event("", string(data))
+	case BinaryMessage:
+		err = c.event("binary", base64.StdEncoding.EncodeToString(data))
+	case CloseMessage:
+		code, text := CloseNoStatusReceived, ""
+		if len(data) >= 2 {
+			code, text = int(binary.BigEndian.Uint16(data)), string(data[2:])
+		}
+		err = c.event("close", strings.TrimSpace(fmt.Sprintf("%d %s", code, text)))
+	case PingMessage:
+		err = c.write(": ping\n\n")
+	case PongMessage:
+	default:
+		err = fmt.Errorf("unknown message type: %d", _type)
+	}
+	c.writing.Unlock()
+
+	switch {
+	case _type == CloseMessage:
+		// clients can not answer the close message, the stream ends here
+		_ = c.Close()
+	case _type == PingMessage && err == nil:
+		c.pong(data)
+	}
+	return err
+}
+
+// event writes an event, callers must hold writing.
+func (c *sConn) event(name string, data string) error {
+	var event strings.Builder
+	if name != "" {
+		event.WriteString("event: " + name + "\n")
+	}
+	data = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(data)
+	for _, line := range strings.Split(data, "\n") {
+		event.WriteString("data: " + line + "\n")
+	}
+	event.WriteString("\n")
+	return c.write(event.String())
+}
+
+// write writes and flushes a chunk of the stream, callers must hold writing.
+func (c *sConn) write(chunk string) error {
+	if _, err := io.WriteString(c.writer, chunk); err != nil {
+		return err
+	}
+	return c.controller.Flush()
+}
+
+// HandleSse serves sessions over Server-Sent Events, for clients behind proxies
+// that do not let websocket upgrades through. GET requests open the event stream
+// of a session and POST requests send the messages of the client, both on the
+// url the handler is mounted on.
+func HandleSse(m *Comet, options ...SseOption) HandlerFunc {
+	opt := newSseOption()
+	for _, option := range options {
+		option(opt)
+	}
+	return serveSse(m, opt, newHTTPStreams())
+}
+
+// serveSse serves event streams registered in streams, which may be shared with
+// other http transports.
+func serveSse(m *Comet, opt *sseOption, streams *httpStreams) HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		switch request.Method {
+		case http.MethodPost:
+			status, err := streams.post(writer, request)
+			if err != nil {
+				opt.reject(writer, request, status, err)
+				return err
+			}
+			writer.WriteHeader(status)
+			return nil
+		case http.MethodGet:
+		default:
+			err := fmt.Errorf("method %s not allowed", request.Method)
+			writer.Header().Set("Allow", "GET, POST")
+			opt.reject(writer, request, http.StatusMethodNotAllowed, err)
+			return err
+		}
+
+		if m.sessions.closed() {
+			opt.reject(writer, request, http.StatusServiceUnavailable, ErrServerClosed)
+			return ErrServerClosed
+		}
+
+		authenticated, status, err := m.authenticate(request)
+		if err != nil {
+			opt.reject(writer, request, status, err)
+			return err
+		}
+
+		conn := &sConn{
+			httpConn:   newHTTPConn(request, opt.bufferSize),
+			writer:     writer,
+			controller: http.NewResponseController(writer),
+		}
+
+		header := writer.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		header.Set("X-Accel-Buffering", "no")
+		writer.WriteHeader(http.StatusOK)
+
+		open := ""
+		if opt.retry > 0 {
+			open = fmt.Sprintf("retry: %d\n", opt.retry.Milliseconds())
+		}
+		if err := conn.write(open + "event: open\ndata: " + conn.token + "\n\n"); err != nil {
+			if errors.Is(err, http.ErrNotSupported) {
+				err = errors.New("comet: response writer does not support flushing")
+			}
+			return err
+		}
+
+		streams.add(conn)
+		defer streams.remove(conn)
+
+		go func() {
+			select {
+			case <-request.Context().Done():
+				_ = conn.Close()
+			case <-conn.done:
+			}
+		}()
+
+		return m.HandleHandshake(conn, NewHandshake(conn, request), requestKeys(request, authenticated))
+	}
+}
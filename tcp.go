@@ -1,56 +1,537 @@
 package comet
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 )
 
+// TCP framing
+//
+// Every message on a tcp connection is a frame made of an 8 byte header
+// followed by the payload:
+//
+//	+----------------+----------------+------------------+
+//	| length: uint32 | type: uint32   | payload          |
+//	| big endian     | big endian     | length bytes     |
+//	+----------------+----------------+------------------+
+//
+// The type is one of TextMessage, BinaryMessage, CloseMessage, PingMessage or
+// PongMessage. The payload of a close frame is the output of FormatCloseMessage,
+// a 2 byte big endian close code followed by the close text, or empty for
+// CloseNoStatusReceived. Ping, pong and close frames are handled by the
+// connection handlers and are never returned by ReadMessage; a close frame
+// makes ReadMessage return a *CloseError. The framing is symmetric, so the same
+// Conn is used on both ends, see DialTCP.
+//
+// The highest bit of the type (1<<31) flags a text or binary payload compressed
+// with raw DEFLATE (RFC 1951), the length is then the compressed size. Every
+// Conn reads compressed frames, only connections with write compression enabled
+// write them, see Compressor and WithTCPCompression.
+//
+// A server started with WithTCPHandshake, or whose comet instance has an
+// authenticator, expects the first frame of a connection to be a HandshakeMessage
+// whose payload is an HTTP/1.1 request head, e.g. "GET /chat?id=1 HTTP/1.1". The
+// request is authenticated like a websocket upgrade request and populates the
+// session Handshake. The server answers with a HandshakeMessage carrying an
+// HTTP/1.1 response head: "101 Switching Protocols" on success, or the rejection
+// status after which the connection is closed. See DialTCPHandshake.
+const (
+	tcpHeaderSize = 4 + 4
+
+	// tcpCompressed flags a compressed payload in the frame type.
+	tcpCompressed = 1 << 31
+
+	// tcpHandshakeLimit is the maximum size in bytes of a handshake frame.
+	tcpHandshakeLimit = 8192
+
+	// HandshakeMessage denotes a tcp handshake frame, it is never returned by
+	// ReadMessage.
+	HandshakeMessage = 16
+)
 
 type AcceptFunc = func(string) error
+
+// ErrBadHandshake is returned by DialTCPHandshake when the server rejects the handshake.
+var ErrBadHandshake = errors.New("comet: bad handshake")
+
+type (
+	// TCPServer accepts tcp connections and dispatches them to a comet instance,
+	// keeping track of its sessions so they can be drained on Shutdown.
+	TCPServer struct {
+		comet    *Comet
+		listener net.Listener
+		sessions *registry
+		option   *tcpOption
+	}
+
+	tcpOption struct {
+		handshake        bool
+		handshakeTimeout time.Duration
+		compression      bool
+	}
+
+	TCPOption func(*tcpOption)
+)
+
+func newTCPOption() *tcpOption {
+	return &tcpOption{
+		handshake:        false,
+		handshakeTimeout: 10 * time.Second,
+		compression:      false,
+	}
+}
+
+// WithTCPCompression lets sessions write compressed frames, which messages are
+// compressed is decided by Conf.CompressThreshold and Session.WriteCompressed.
+// Clients must understand compressed frames, as DialTCP connections do.
+func WithTCPCompression() TCPOption {
+	return func(option *tcpOption) {
+		option.compression = true
+	}
+}
+
+// WithTCPHandshake makes the server expect a handshake frame within timeout
+// from every connection. Servers whose comet instance has an authenticator
+// always expect one.
+func WithTCPHandshake(timeout time.Duration) TCPOption {
+	return func(option *tcpOption) {
+		option.handshake = true
+		option.handshakeTimeout = timeout
+	}
+}
+
 // tcp conn
 type tConn struct {
 	net.Conn
-	readLimit int64
-	handlePong func(string) error
-	handlePing func(string) error
-	handleClose func(int,string) error
+	readLimit   int64
+	writeMutex  sync.Mutex
+	deadline    time.Time // write deadline set by SetWriteDeadline, guarded by writeMutex
+	compress    bool
+	level       int
+	deflater    *flate.Writer
+	handlePong  func(string) error
+	handlePing  func(string) error
+	handleClose func(int, string) error
 }
 
 func NewTConn(conn net.Conn) Conn {
-	c := &tConn{Conn:conn}
-	c.SetPongHandler(func(s string) error {return nil})
-	c.SetPingHandler(func(s string) error {return nil})
-	c.SetCloseHandler(func(i int, s string) error {return nil})
+	return newTConn(conn)
+}
+
+// NetConn returns the underlying connection.
+func (c *tConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func newTConn(conn net.Conn) *tConn {
+	c := &tConn{Conn: conn, level: flate.BestSpeed}
+	c.SetPongHandler(nil)
+	c.SetPingHandler(nil)
+	c.SetCloseHandler(nil)
 	return c
 }
 
-func HandelTcp(m *Comet)  AcceptFunc {
+// DialTCP connects to a tcp comet server at addr.
+func DialTCP(addr string) (Conn, error) {
+	return Dial("tcp", addr)
+}
+
+// Dial connects to a comet server listening on network at addr, e.g. a unix
+// socket with Dial("unix", "/run/comet.sock").
+func Dial(network string, addr string) (Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTConn(conn), nil
+}
+
+// DialTLS connects to a comet server at addr over TLS with config, which holds
+// the client certificate of servers requiring one.
+func DialTLS(addr string, config *tls.Config) (Conn, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewTConn(conn), nil
+}
+
+// DialTCPHandshake connects to a tcp comet server at addr and sends a handshake
+// frame requesting path, which may carry a query, with header. The server
+// response is returned, ErrBadHandshake is returned if the server rejected it.
+func DialTCPHandshake(addr string, path string, header http.Header) (Conn, *http.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ClientHandshake(conn, addr, path, header)
+}
+
+// ClientHandshake sends a handshake frame requesting path of host with header
+// on conn, which may be a unix or TLS connection, and reads the response like
+// DialTCPHandshake. conn is closed if the handshake fails.
+func ClientHandshake(conn net.Conn, host string, path string, header http.Header) (Conn, *http.Response, error) {
+	c := newTConn(conn)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+
+	var head bytes.Buffer
+	if err = req.Write(&head); err == nil {
+		err = c.WriteMessage(HandshakeMessage, head.Bytes())
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+
+	c.SetReadLimit(tcpHandshakeLimit)
+	_type, data, err := c.readFrame()
+	c.SetReadLimit(0)
+	if err == nil && _type != HandshakeMessage {
+		err = fmt.Errorf("unexpected frame type: %d", _type)
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = c.Close()
+		return nil, resp, ErrBadHandshake
+	}
+	return c, resp, nil
+}
+
+func HandelTcp(m *Comet) AcceptFunc {
 	return func(addr string) error {
-		listener, err := net.Listen("tcp", addr)
+		srv, err := ListenTCP(m, addr)
 		if err != nil {
 			return err
 		}
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return err
+		return srv.Serve(context.Background())
+	}
+}
+
+// ListenTCP listens on the tcp address addr and returns a server for m.
+func ListenTCP(m *Comet, addr string, options ...TCPOption) (*TCPServer, error) {
+	return Listen(m, "tcp", addr, options...)
+}
+
+// Listen listens on network at addr and returns a server for m, e.g. a unix
+// socket with Listen(m, "unix", "/run/comet.sock"). Sessions of unix socket
+// connections expose the credentials of the peer process in Handshake.Credentials.
+func Listen(m *Comet, network string, addr string, options ...TCPOption) (*TCPServer, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPServer(m, listener, options...), nil
+}
+
+// ListenTLS listens on the tcp address addr for TLS connections configured by
+// config and returns a server for m. Servers requiring client certificates set
+// config.ClientAuth, sessions expose the peer certificates in Handshake.TLS.
+func ListenTLS(m *Comet, addr string, config *tls.Config, options ...TCPOption) (*TCPServer, error) {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPServer(m, listener, options...), nil
+}
+
+// NewTCPServer returns a server accepting connections on listener for m, which
+// may be any net.Listener such as a unix socket or tls.NewListener listener.
+func NewTCPServer(m *Comet, listener net.Listener, options ...TCPOption) *TCPServer {
+	opt := newTCPOption()
+	for _, option := range options {
+		option(opt)
+	}
+	return &TCPServer{
+		comet:    m,
+		listener: listener,
+		sessions: newRegistry(),
+		option:   opt,
+	}
+}
+
+// Addr returns the listener network address.
+func (srv *TCPServer) Addr() net.Addr {
+	return srv.listener.Addr()
+}
+
+// Serve accepts connections until ctx is done or Shutdown is called, each
+// connection is handled in its own goroutine. Cancelling ctx only stops
+// accepting, sessions keep running until they are drained with Shutdown.
+func (srv *TCPServer) Serve(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = srv.listener.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			if srv.sessions.closed() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
-			go m.Handle(NewTConn(conn), map[string]interface{}{})
+			return err
 		}
+
+		go srv.serveConn(newTConn(conn))
+	}
+}
+
+func (srv *TCPServer) serveConn(conn *tConn) {
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		// complete the TLS handshake so the peer certificates are known
+		ctx, cancel := context.WithTimeout(context.Background(), srv.option.handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+
+	var handshake *Handshake
+	keys := map[string]interface{}{}
+	if srv.option.handshake || srv.comet.authenticateHandler != nil {
+		var err error
+		if handshake, keys, err = srv.handshake(conn); err != nil {
+			_ = conn.Close()
+			return
+		}
+	} else {
+		handshake = NewHandshake(conn, nil)
+	}
+
+	handshake.Compression = srv.option.compression
+	session := srv.comet.newSession(handshake.context(), conn, handshake, keys)
+	if !srv.sessions.add(session) {
+		_ = conn.Close()
+		session.cancel(ErrServerClosed)
+		return
+	}
+	_ = srv.comet.handle(session)
+	srv.sessions.remove(session)
+}
+
+// handshake reads the handshake frame of conn, authenticates its request and
+// answers it with a handshake response frame.
+func (srv *TCPServer) handshake(conn *tConn) (*Handshake, map[string]interface{}, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(srv.option.handshakeTimeout))
+	conn.SetReadLimit(tcpHandshakeLimit)
+	_type, data, err := conn.readFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _type != HandshakeMessage {
+		err = fmt.Errorf("unexpected frame type: %d", _type)
+		srv.respond(conn, http.StatusBadRequest)
+		return nil, nil, err
 	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		srv.respond(conn, http.StatusBadRequest)
+		return nil, nil, err
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		req.TLS = tlsState(tlsConn)
+	}
+
+	keys, status, err := srv.comet.authenticate(req)
+	if err != nil {
+		srv.respond(conn, status)
+		return nil, nil, err
+	}
+
+	srv.respond(conn, http.StatusSwitchingProtocols)
+	return NewHandshake(conn, req), keys, nil
+}
+
+// respond writes a handshake response frame with status.
+func (srv *TCPServer) respond(conn *tConn, status int) {
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	var head bytes.Buffer
+	_ = resp.Write(&head)
+	_ = conn.SetWriteDeadline(time.Now().Add(srv.comet.Config.WriteWait))
+	_ = conn.WriteMessage(HandshakeMessage, head.Bytes())
+}
+
+// Shutdown stops accepting connections, sends a going away close frame to
+// every session and waits until their write pumps flushed and they disconnected.
+// If ctx is done first, the remaining sessions are closed and reported in a
+// *ShutdownError.
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	if !srv.sessions.close() {
+		return ErrServerClosed
+	}
+	err := srv.listener.Close()
+	if e := srv.sessions.drain(ctx, FormatCloseMessage(CloseGoingAway, "server shutdown")); e != nil {
+		return e
+	}
+	return err
+}
+
+// Len returns the number of sessions handled by the server.
+func (srv *TCPServer) Len() int {
+	return srv.sessions.len()
 }
 
 func (c *tConn) WriteMessage(_type int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	buffer, err := c.encode(_type, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buffer)
+	return err
+}
+
+// SetWriteDeadline sets the write deadline of the connection, it is restored
+// after control frames written by the default handlers.
+func (c *tConn) SetWriteDeadline(t time.Time) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.deadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// writeControl writes a control frame with its own write deadline and restores
+// the deadline set with SetWriteDeadline afterwards.
+func (c *tConn) writeControl(_type int, data []byte, deadline time.Time) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_ = c.Conn.SetWriteDeadline(deadline)
+	defer c.Conn.SetWriteDeadline(c.deadline)
+
+	buffer, err := c.encode(_type, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buffer)
+	return err
+}
+
+// WritePreparedMessage writes pm, its frame is encoded once per compression setting.
+func (c *tConn) WritePreparedMessage(pm *PreparedMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	key := tcpFrameKey{compress: c.compress, level: c.level}
+	buffer, err := pm.frame(key, func() ([]byte, error) {
+		return c.encode(pm.t, pm.msg)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buffer)
+	return err
+}
+
+// encode builds the frame of a message, callers must hold the write lock.
+func (c *tConn) encode(_type int, data []byte) ([]byte, error) {
+	frameType := uint32(_type)
+	if c.compress && (_type == TextMessage || _type == BinaryMessage) {
+		compressed, err := c.deflate(data)
+		if err != nil {
+			return nil, err
+		}
+		data = compressed
+		frameType |= tcpCompressed
+	}
+
 	size := len(data)
-	buffer := make([]byte, 4+4+size)
+	buffer := make([]byte, tcpHeaderSize+size)
 	binary.BigEndian.PutUint32(buffer[:4], uint32(size))
-	binary.BigEndian.PutUint32(buffer[4:8], uint32(_type))
-	copy(buffer[8:], data)
-	_, err := c.Write(data)
-	return err
+	binary.BigEndian.PutUint32(buffer[4:8], frameType)
+	copy(buffer[tcpHeaderSize:], data)
+	return buffer, nil
+}
+
+// deflate compresses data, callers must hold the write lock.
+func (c *tConn) deflate(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	if c.deflater == nil {
+		deflater, err := flate.NewWriter(&compressed, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.deflater = deflater
+	} else {
+		c.deflater.Reset(&compressed)
+	}
+	if _, err := c.deflater.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.deflater.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// EnableWriteCompression enables and disables compression of subsequent
+// text and binary frames.
+func (c *tConn) EnableWriteCompression(enable bool) {
+	c.writeMutex.Lock()
+	c.compress = enable
+	c.writeMutex.Unlock()
+}
+
+// SetCompressionLevel sets the flate compression level for subsequent frames.
+func (c *tConn) SetCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return errors.New("comet: invalid compression level")
+	}
+	c.writeMutex.Lock()
+	if level != c.level {
+		c.level = level
+		c.deflater = nil
+	}
+	c.writeMutex.Unlock()
+	return nil
 }
 
 func (c *tConn) SetReadLimit(size int64) {
@@ -58,14 +539,49 @@ func (c *tConn) SetReadLimit(size int64) {
 }
 
 func (c *tConn) ReadMessage() (int, []byte, error) {
-	header := make([]byte, 4+4)
-	_ , err := io.ReadFull(c, header)
-	if err !=nil {
+	for {
+		_type, data, err := c.readFrame()
+		if err != nil {
+			return NoFrame, nil, err
+		}
+
+		switch _type {
+		case TextMessage, BinaryMessage:
+			return _type, data, nil
+		case PingMessage:
+			if err := c.handlePing(string(data)); err != nil {
+				return NoFrame, nil, fmt.Errorf("handle ping err: %s", err)
+			}
+		case PongMessage:
+			if err := c.handlePong(string(data)); err != nil {
+				return NoFrame, nil, fmt.Errorf("handle pong err: %s", err)
+			}
+		case CloseMessage:
+			code := CloseNoStatusReceived
+			text := ""
+			if len(data) >= 2 {
+				code = int(binary.BigEndian.Uint16(data))
+				text = string(data[2:])
+			}
+			if err := c.handleClose(code, text); err != nil {
+				return NoFrame, nil, fmt.Errorf("handle close err: %+v", err)
+			}
+			return NoFrame, nil, &CloseError{Code: code, Text: text}
+		default:
+			return NoFrame, nil, fmt.Errorf("unknown frame type: %d", _type)
+		}
+	}
+}
+
+func (c *tConn) readFrame() (int, []byte, error) {
+	header := make([]byte, tcpHeaderSize)
+	_, err := io.ReadFull(c.Conn, header)
+	if err != nil {
 		return NoFrame, nil, fmt.Errorf("read header err: %s", err)
 	}
 
 	size := binary.BigEndian.Uint32(header[:4])
-	if c.readLimit>0 && int64(size) > c.readLimit {
+	if c.readLimit > 0 && int64(size) > c.readLimit {
 		return NoFrame, nil, fmt.Errorf("the data size %d is beyond the max: %d", size, c.readLimit)
 	}
 
@@ -76,45 +592,49 @@ func (c *tConn) ReadMessage() (int, []byte, error) {
 	if err != nil {
 		return NoFrame, nil, fmt.Errorf("read data err: %s", err)
 	}
-	switch _type {
-	case PingMessage:
-		err := c.handlePing(string(data))
-		if err != nil {
-			return NoFrame, nil, fmt.Errorf("handle ping err: %s", err)
-		}
-	case PongMessage:
-		err := c.handlePong(string(data))
-		if err != nil {
-			return NoFrame, nil, fmt.Errorf("handle pong err: %s", err)
-		}
-	case CloseMessage:
-		code := CloseNoStatusReceived
-		text := ""
-		if size >= 2 {
-			code = int(binary.BigEndian.Uint16(data))
-			text = string(data[2:])
-		}
-		err := c.handleClose(code, text)
-		if err != nil {
-			return NoFrame, nil, fmt.Errorf("handle close err: %+v", err)
+
+	if _type&tcpCompressed != 0 {
+		_type &^= tcpCompressed
+		if data, err = c.inflate(data); err != nil {
+			return NoFrame, nil, err
 		}
 	}
 	return int(_type), data, nil
 }
 
+// inflate decompresses data, enforcing the read limit on the decompressed size.
+func (c *tConn) inflate(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	var limited io.Reader = reader
+	if c.readLimit > 0 {
+		limited = io.LimitReader(reader, c.readLimit+1)
+	}
+	inflated, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, fmt.Errorf("inflate data err: %s", err)
+	}
+	if c.readLimit > 0 && int64(len(inflated)) > c.readLimit {
+		return nil, fmt.Errorf("the data size %d is beyond the max: %d", len(inflated), c.readLimit)
+	}
+	return inflated, nil
+}
+
 func (c *tConn) SetPongHandler(f func(string) error) {
 	if f == nil {
-		f = func(s string) error {return nil}
+		f = func(s string) error { return nil }
 	}
 	c.handlePong = f
 }
 
-func (c *tConn) SetPingHandler(f func(string) error)  {
+// SetPingHandler sets the handler for ping frames, the default handler
+// replies with a pong frame carrying the same payload.
+func (c *tConn) SetPingHandler(f func(string) error) {
 	if f == nil {
 		f = func(msg string) error {
-			_ = c.SetWriteDeadline(time.Now().Add(time.Second))
-			err := c.WriteMessage(PingMessage, []byte(msg))
-			if e, ok := err.(net.Error); ok && e.Temporary() {
+			err := c.writeControl(PongMessage, []byte(msg), time.Now().Add(time.Second))
+			if e, ok := err.(net.Error); ok && e.Timeout() {
 				return nil
 			}
 			return err
@@ -123,12 +643,13 @@ func (c *tConn) SetPingHandler(f func(string) error)  {
 	c.handlePing = f
 }
 
+// SetCloseHandler sets the handler for close frames, the default handler
+// echoes the close code back to the peer.
 func (c *tConn) SetCloseHandler(f func(int, string) error) {
 	if f == nil {
 		f = func(code int, text string) error {
-			msg := FormatCloseMessage(code, text)
-			_ = c.SetWriteDeadline(time.Now().Add(time.Second))
-			_ = c.WriteMessage(CloseMessage, msg)
+			msg := FormatCloseMessage(code, "")
+			_ = c.writeControl(CloseMessage, msg, time.Now().Add(time.Second))
 			return nil
 		}
 	}
@@ -145,4 +666,4 @@ func FormatCloseMessage(code int, text string) []byte {
 	binary.BigEndian.PutUint16(buf, uint16(code))
 	copy(buf[2:], text)
 	return buf
-}
\ No newline at end of file
+}